@@ -44,23 +44,50 @@ type LogOut struct {
 	NonMesosNXDomain Counter
 	NonMesosFailed   Counter
 	NonMesosRecursed Counter
+	Reloads          Counter
+	RecordChanges    Counter
+	StubRequests     Counter
+	StubCacheHits    Counter
+	StubFailed       Counter
+	Refused          Counter
+	RateLimited      Counter
+	RRLDropped       Counter
+	RRLSlipped       Counter
 }
 
-var CurLog = LogOut{
-	MesosRequests:    &LogCounter{},
-	MesosSuccess:     &LogCounter{},
-	MesosNXDomain:    &LogCounter{},
-	MesosFailed:      &LogCounter{},
-	NonMesosRequests: &LogCounter{},
-	NonMesosSuccess:  &LogCounter{},
-	NonMesosNXDomain: &LogCounter{},
-	NonMesosFailed:   &LogCounter{},
-	NonMesosRecursed: &LogCounter{},
+// NewLogOut returns a set of counters, all zero
+func NewLogOut() *LogOut {
+	return &LogOut{
+		MesosRequests:    &LogCounter{},
+		MesosSuccess:     &LogCounter{},
+		MesosNXDomain:    &LogCounter{},
+		MesosFailed:      &LogCounter{},
+		NonMesosRequests: &LogCounter{},
+		NonMesosSuccess:  &LogCounter{},
+		NonMesosNXDomain: &LogCounter{},
+		NonMesosFailed:   &LogCounter{},
+		NonMesosRecursed: &LogCounter{},
+		Reloads:          &LogCounter{},
+		RecordChanges:    &LogCounter{},
+		StubRequests:     &LogCounter{},
+		StubCacheHits:    &LogCounter{},
+		StubFailed:       &LogCounter{},
+		Refused:          &LogCounter{},
+		RateLimited:      &LogCounter{},
+		RRLDropped:       &LogCounter{},
+		RRLSlipped:       &LogCounter{},
+	}
+}
+
+// Print prints out the counters
+func (lo *LogOut) Print() {
+	VeryVerbose.Printf("%+v\n", *lo)
 }
 
-// PrintCurLog prints out the current LogOut and then resets
-func PrintCurLog() {
-	VeryVerbose.Printf("%+v\n", CurLog)
+// Flush prints out the counters and flushes the logs, e.g. before exiting
+func (lo *LogOut) Flush() {
+	Verbose.Printf("%+v\n", *lo)
+	glog.Flush()
 }
 
 // SetupLogs provides the following logs
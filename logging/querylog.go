@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Query is an entry of the query log
+type Query struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Proto    string    `json:"proto"`
+	Name     string    `json:"qname"`
+	Type     string    `json:"qtype"`
+	Rcode    string    `json:"rcode,omitempty"`
+	Answers  int       `json:"answers"`
+	Latency  float64   `json:"latency_ms"`
+	Handler  string    `json:"handler"`
+	Upstream string    `json:"upstream,omitempty"`
+	Dropped  bool      `json:"dropped,omitempty"`
+}
+
+// QueryLog writes queries as JSON lines to stdout or to a file, which is
+// rotated once it reaches its maximum size
+type QueryLog struct {
+	path       string // "" for stdout
+	maxSize    int64  // 0 never rotates
+	maxBackups int
+	sample     uint64
+	count      uint64 // queries seen, accessed atomically
+
+	lock sync.Mutex
+	out  io.Writer
+	file *os.File
+	size int64
+}
+
+// NewQueryLog returns a query log writing to path, or to stdout for "-".
+// the file is rotated once it reaches maxSize bytes, keeping maxBackups
+// old files named path.1, path.2, etc. one query in sample is logged.
+func NewQueryLog(path string, maxSize int64, maxBackups int, sample int) (*QueryLog, error) {
+	ql := &QueryLog{maxSize: maxSize, maxBackups: maxBackups, sample: uint64(sample)}
+	if ql.sample == 0 {
+		ql.sample = 1
+	}
+	if path == "-" {
+		ql.out = os.Stdout
+		return ql, nil
+	}
+	ql.path = path
+	if err := ql.open(); err != nil {
+		return nil, err
+	}
+	return ql, nil
+}
+
+// Sampled returns true for the queries to log, one in sample
+func (ql *QueryLog) Sampled() bool {
+	return atomic.AddUint64(&ql.count, 1)%ql.sample == 0
+}
+
+// Log writes the query as a line of JSON
+func (ql *QueryLog) Log(q *Query) {
+	b, err := json.Marshal(q)
+	if err != nil {
+		Error.Println(err)
+		return
+	}
+	b = append(b, '\n')
+
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
+	if ql.file != nil && ql.maxSize > 0 && ql.size > 0 && ql.size+int64(len(b)) > ql.maxSize {
+		if err := ql.rotate(); err != nil {
+			Error.Println("query log not rotated: " + err.Error())
+		}
+	}
+	if ql.out == nil {
+		return
+	}
+	n, err := ql.out.Write(b)
+	ql.size += int64(n)
+	if err != nil {
+		Error.Println(err)
+	}
+}
+
+// Close closes the file of the query log
+func (ql *QueryLog) Close() error {
+	ql.lock.Lock()
+	defer ql.lock.Unlock()
+	if ql.file == nil {
+		return nil
+	}
+	err := ql.file.Close()
+	ql.file, ql.out = nil, nil
+	return err
+}
+
+// open opens the file for appending, the log must be locked
+func (ql *QueryLog) open() error {
+	f, err := os.OpenFile(ql.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ql.file, ql.out, ql.size = f, f, fi.Size()
+	return nil
+}
+
+// rotate shifts the old files, moves the file to path.1 and opens a new
+// one, the log must be locked. the queries keep going to the old file
+// until the new one is open, and if it can't be, until maxSize more bytes
+// are written.
+func (ql *QueryLog) rotate() error {
+	if ql.maxBackups > 0 {
+		for i := ql.maxBackups - 1; i > 0; i-- {
+			os.Rename(ql.backup(i), ql.backup(i+1))
+		}
+		if err := os.Rename(ql.path, ql.backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(ql.path); err != nil {
+		return err
+	}
+	old := ql.file
+	if err := ql.open(); err != nil {
+		ql.size = 0
+		return err
+	}
+	return old.Close()
+}
+
+func (ql *QueryLog) backup(i int) string {
+	return ql.path + "." + strconv.Itoa(i)
+}
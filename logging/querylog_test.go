@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryLog(t *testing.T) {
+	SetupLogs()
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	ql, err := NewQueryLog(path, 500, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &Query{Time: time.Now(), Client: "10.0.0.1", Proto: "udp", Name: "leader.mesos.", Type: "A", Rcode: "NOERROR", Answers: 1, Handler: "mesos"}
+	for i := 0; i < 20; i++ {
+		ql.Log(q)
+	}
+	if err = ql.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated, keeping 2 backups
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Size() > 500 {
+			t.Errorf("expected %s to be rotated at 500 bytes instead of %d", name, fi.Size())
+		}
+	}
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("expected at most 2 backups")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		t.Fatal("expected queries in the log")
+	}
+	var got map[string]interface{}
+	if err = json.Unmarshal(s.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["qname"] != "leader.mesos." || got["rcode"] != "NOERROR" || got["answers"] != float64(1) || got["handler"] != "mesos" {
+		t.Errorf("unexpected query %v", got)
+	}
+}
+
+func TestQueryLogRotateFailure(t *testing.T) {
+	SetupLogs()
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the backup can't be replaced by the file
+	path := filepath.Join(dir, "queries.log")
+	if err = os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ql, err := NewQueryLog(path, 500, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &Query{Time: time.Now(), Client: "10.0.0.1", Proto: "udp", Name: "leader.mesos.", Type: "A", Handler: "mesos"}
+	for i := 0; i < 20; i++ {
+		ql.Log(q)
+	}
+	ql.Close()
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(b), "\n"); n != 20 {
+		t.Errorf("expected the queries to keep going to the file instead of %d of 20", n)
+	}
+}
+
+func TestQueryLogSample(t *testing.T) {
+	ql, err := NewQueryLog("-", 0, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sampled := 0
+	for i := 0; i < 9; i++ {
+		if ql.Sampled() {
+			sampled++
+		}
+	}
+	if sampled != 3 {
+		t.Errorf("expected one query in 3 to be sampled instead of %d in 9", sampled)
+	}
+}
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/mesosphere/mesos-dns/logging"
@@ -14,6 +17,8 @@ import (
 
 const (
 	zkInitialDetectionTimeout = 4 * time.Minute
+	// time to finish the requests in progress when stopping
+	shutdownTimeout = 10 * time.Second
 )
 
 func main() {
@@ -38,12 +43,15 @@ func main() {
 	// initialize logging
 	logging.SetupLogs()
 
+	// stop gracefully on SIGTERM and Ctrl-C
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+
 	// initialize resolver
 	config := records.SetConfig(*cjson)
 	resolver := resolver.New(version, config)
 
-	var dnsErr, httpErr, zkErr <-chan error
-	var newLeader <-chan struct{}
+	var dnsErr, httpErr <-chan error
 
 	// launch DNS server
 	if config.DnsOn {
@@ -55,10 +63,9 @@ func main() {
 		httpErr = resolver.LaunchHTTP()
 	}
 
-	// launch Zookeeper listener
-	if config.Zk != "" {
-		newLeader, zkErr = resolver.LaunchZK(zkInitialDetectionTimeout)
-	}
+	// periodic loading of DNS state of every cluster (pull from Master),
+	// along with the Zookeeper listeners and event streams
+	zkErr := resolver.LaunchRefresh(zkInitialDetectionTimeout)
 
 	handleServerErr := func(name string, err error) {
 		if err != nil {
@@ -68,39 +75,22 @@ func main() {
 		}
 	}
 
-	reloadSignal := make(chan struct{}, 1)
-	tryReload := func() {
-		// non-blocking, attempt to queue a reload
-		select {
-		case reloadSignal <- struct{}{}:
-		default:
-		}
-	}
-
-	// periodic loading of DNS state (pull from Master)
-	go func() {
-		defer util.HandleCrash()
-		reloadTimeout := time.Second * time.Duration(config.RefreshSeconds)
-		reloadTimer := time.AfterFunc(reloadTimeout, tryReload)
-		for _ = range reloadSignal {
-			resolver.Reload()
-			logging.PrintCurLog()
-			reloadTimer.Reset(reloadTimeout)
-		}
-	}()
-
-	tryReload()
-
 	for {
 		select {
-		case <-newLeader:
-			tryReload()
 		case err := <-dnsErr:
 			handleServerErr("DNS server", err)
 		case err := <-httpErr:
 			handleServerErr("HTTP server", err)
 		case err := <-zkErr:
 			handleServerErr("ZK watcher", err)
+		case sig := <-sigCh:
+			logging.Verbose.Printf("Received %v, stopping", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			if err := resolver.Stop(ctx); err != nil {
+				logging.Error.Printf("Failed to stop gracefully: %v", err)
+			}
+			cancel()
+			os.Exit(0)
 		}
 	}
 }
@@ -0,0 +1,88 @@
+package records
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// HTTPRoutes are the routes of the HTTP API, which the HTTP ACLs restrict
+var HTTPRoutes = []string{
+	"/v1/version",
+	"/health",
+	"/v1/config",
+	"/v1/status",
+	"/v1/clusters",
+	"/v1/stubzones",
+	"/v1/hosts/{host}",
+	"/v1/hosts/{host}/ports",
+	"/v1/services/{service}",
+}
+
+// ACLs restrict the clients of mesos-dns to networks, each list of
+// networks holds CIDRs or IP addresses. All clients are allowed unless a
+// list is given, an empty list allows none.
+type ACLs struct {
+	// Query: clients allowed to query the Mesos domains and stub zones
+	Query []string
+	// Recursion: clients allowed to have external requests forwarded
+	Recursion []string
+	// Transfer: clients allowed to request zone transfers (AXFR and IXFR),
+	// which get NOTIMP answers since transfers aren't supported
+	Transfer []string
+	// HTTP: clients allowed to use each route of the HTTP API, e.g.
+	// "/v1/config" or "/v1/hosts/{host}", "*" for the routes not listed
+	HTTP map[string][]string
+}
+
+// validate checks that every network of the ACLs is valid, and that the
+// HTTP ACLs are for routes of the HTTP API
+func (a ACLs) validate() error {
+	routes := map[string]bool{"*": true}
+	for _, route := range HTTPRoutes {
+		routes[route] = true
+	}
+	lists := [][]string{a.Query, a.Recursion, a.Transfer}
+	for route, networks := range a.HTTP {
+		if !routes[route] {
+			return errors.New("HTTP ACL of unknown route " + route)
+		}
+		lists = append(lists, networks)
+	}
+	for _, networks := range lists {
+		if _, err := ParseNetworks(networks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseNetworks returns the networks of a list of CIDRs or IP addresses,
+// an address being a network of its own. It returns nil for a nil list.
+func ParseNetworks(networks []string) ([]*net.IPNet, error) {
+	if networks == nil {
+		return nil, nil
+	}
+	nets := make([]*net.IPNet, 0, len(networks))
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		if !strings.Contains(n, "/") {
+			ip := net.ParseIP(n)
+			if ip == nil {
+				return nil, errors.New("invalid network " + n)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, errors.New("invalid network " + n)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
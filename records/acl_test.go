@@ -0,0 +1,54 @@
+package records
+
+import (
+	"net"
+	"testing"
+)
+
+func TestACLsValidate(t *testing.T) {
+	valid := ACLs{HTTP: map[string][]string{"/v1/config": {"127.0.0.1"}, "*": {}}}
+	if err := valid.validate(); err != nil {
+		t.Error(err)
+	}
+	for _, a := range []ACLs{
+		{Query: []string{"10.0.0.0/33"}},
+		{Transfer: []string{"localhost"}},
+		{HTTP: map[string][]string{"/v1/confg": {"127.0.0.1"}}},
+	} {
+		if err := a.validate(); err == nil {
+			t.Errorf("expected an error for the ACLs %v", a)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	if nets, err := ParseNetworks(nil); err != nil || nets != nil {
+		t.Errorf("expected no networks for nil instead of %v, %v", nets, err)
+	}
+	if nets, err := ParseNetworks([]string{}); err != nil || nets == nil || len(nets) != 0 {
+		t.Errorf("expected an empty list of networks instead of %v, %v", nets, err)
+	}
+
+	nets, err := ParseNetworks([]string{"10.0.0.0/8", "192.168.1.5", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, contained := range map[string][]bool{
+		"10.1.2.3":    {true, false, false},
+		"192.168.1.5": {false, true, false},
+		"192.168.1.6": {false, false, false},
+		"::1":         {false, false, true},
+	} {
+		for i, n := range nets {
+			if n.Contains(net.ParseIP(ip)) != contained[i] {
+				t.Errorf("expected %s in %s to be %v", ip, n, contained[i])
+			}
+		}
+	}
+
+	for _, networks := range [][]string{{"10.0.0.0/33"}, {"localhost"}, {""}} {
+		if _, err := ParseNetworks(networks); err == nil {
+			t.Errorf("expected an error for %q", networks)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package records
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records/labels"
+	"github.com/miekg/dns"
+)
+
+// AliasLabel is the task label holding the aliases of a task, a comma
+// separated list of names relative to the domain, e.g. "payments,api.shop"
+const AliasLabel = "DNS_ALIAS"
+
+// alias is a CNAME record from name to target
+type alias struct {
+	name   string
+	target string
+	owner  *Owner
+}
+
+// configAliases returns the aliases of the config, sorted by name
+func configAliases(c Config, spec *labelSpec) ([]alias, error) {
+	names := make([]string, 0, len(c.Aliases))
+	for name := range c.Aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliases := make([]alias, 0, len(names))
+	for _, n := range names {
+		name, err := aliasName(n, c.Domain, spec)
+		if err != nil {
+			return nil, err
+		}
+		target, err := aliasTarget(c.Aliases[n], c.Domain)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, alias{name: name, target: target})
+	}
+	return aliases, nil
+}
+
+// taskAliases returns the aliases of a task from its AliasLabel, all of
+// them pointing at target
+func taskAliases(n *taskNaming, domain string, target string, owner *Owner) []alias {
+	var aliases []alias
+	for _, a := range strings.Split(n.labels[AliasLabel], ",") {
+		if a = strings.TrimSpace(a); a == "" {
+			continue
+		}
+		name, err := aliasName(a, domain, n.spec)
+		if err != nil {
+			logging.VeryVerbose.Println("Warning: skipping alias of task " + owner.TaskID + ": " + err.Error())
+			continue
+		}
+		aliases = append(aliases, alias{name: name, target: target, owner: owner})
+	}
+	return aliases
+}
+
+// aliasName returns the fully qualified name of an alias, which is
+// relative to the domain unless it ends with a dot
+func aliasName(name string, domain string, spec *labelSpec) (string, error) {
+	name = strings.ToLower(name)
+	if strings.HasSuffix(name, ".") {
+		rel := strings.TrimSuffix(name, "."+domain+".")
+		if rel == name {
+			return "", fmt.Errorf("alias %q outside of the domain", name)
+		}
+		name = rel
+	}
+	for _, label := range strings.Split(name, ".") {
+		if !spec.valid(label) {
+			return "", fmt.Errorf("invalid label %q in alias %q", label, name)
+		}
+	}
+	return fqdn(name, domain)
+}
+
+// aliasTarget returns the fully qualified target of an alias, which is
+// relative to the domain unless it ends with a dot
+func aliasTarget(target string, domain string) (string, error) {
+	target = strings.ToLower(target)
+	if !strings.HasSuffix(target, ".") {
+		target += "." + domain + "."
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(target, "."), ".") {
+		if !labels.IsRFC1123(label) {
+			return "", fmt.Errorf("invalid label %q in alias target %q", label, target)
+		}
+	}
+	return target, nil
+}
+
+// insertAliases inserts a CNAME record for every alias, unless its name
+// already has other records or is the alias of another target
+func (rg *RecordGenerator) insertAliases(aliases []alias, origins nameOrigins) {
+	for _, a := range aliases {
+		if a.name == a.target {
+			logging.VeryVerbose.Println("Warning: skipping alias " + a.name + " of itself")
+			continue
+		}
+		if !origins.claim(a.name, "alias of "+a.target) {
+			continue
+		}
+		if hasOtherThanCNAME(rg.Records[a.name]) {
+			logging.Error.Println("alias " + a.name + " conflicts with generated records, skipping it")
+			continue
+		}
+		rg.insertCNAME(a.name, a.target, a.owner)
+	}
+}
+
+// hasOtherThanCNAME returns true if set has records of types other than
+// CNAME
+func hasOtherThanCNAME(set RRSet) bool {
+	for rrtype, recs := range set {
+		if rrtype != dns.TypeCNAME && len(recs) > 0 {
+			return true
+		}
+	}
+	return false
+}
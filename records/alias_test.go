@@ -0,0 +1,67 @@
+package records
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestInsertStateAliases(t *testing.T) {
+	sj := fakeTasksState("liquor-store", "chronos", "nginx")
+	sj.Frameworks[0].Tasks[0].Labels = []Label{{Key: AliasLabel, Value: "shop, store.shops,bad_label"}}
+	sj.Frameworks[0].Tasks[1].Labels = []Label{{Key: AliasLabel, Value: "shop"}}
+	sj.Frameworks[0].Tasks[2].Labels = []Label{{Key: AliasLabel, Value: "liquor-store.marathon"}}
+
+	c := fakeConfig()
+	c.Aliases = map[string]string{
+		"registry":      "nginx.marathon",
+		"legacy.mesos.": "legacy.example.com.",
+	}
+
+	var rg RecordGenerator
+	if err := rg.InsertState(sj, c); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, target := range map[string]string{
+		"shop.mesos.":        "liquor-store.marathon.mesos.",
+		"store.shops.mesos.": "liquor-store.marathon.mesos.",
+		"registry.mesos.":    "nginx.marathon.mesos.",
+		"legacy.mesos.":      "legacy.example.com.",
+	} {
+		recs := rg.Lookup(name, dns.TypeCNAME)
+		if len(recs) != 1 {
+			t.Errorf("expected 1 CNAME record of %s instead of %d", name, len(recs))
+			continue
+		}
+		if cname := recs[0].RR.(*dns.CNAME); cname.Target != target {
+			t.Errorf("expected %s to be an alias of %s instead of %s", name, target, cname.Target)
+		}
+	}
+
+	if recs := rg.Lookup("shop.mesos.", dns.TypeCNAME); recs[0].Owner == nil || recs[0].Owner.TaskName != "liquor-store" {
+		t.Error("should keep the first task claiming an alias")
+	}
+	if rg.Exists("bad_label.mesos.") {
+		t.Error("should skip invalid aliases")
+	}
+	if len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeCNAME)) != 0 ||
+		len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA)) != 1 {
+		t.Error("should not alias names with generated records")
+	}
+}
+
+func TestConfigAliases(t *testing.T) {
+	spec := labelSpecs[LabelSpecRFC952]
+	for _, aliases := range []map[string]string{
+		{"outside.example.com.": "app.marathon"},
+		{"in_valid": "app.marathon"},
+		{"app": "in valid"},
+	} {
+		c := fakeConfig()
+		c.Aliases = aliases
+		if _, err := configAliases(c, spec); err == nil {
+			t.Errorf("expected an error for the aliases %v", aliases)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package records
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -69,6 +71,327 @@ type Config struct {
 
 	// Enable replies for external requests
 	ExternalOn bool
+
+	// DNSListeners: addresses (ip or ip:port) to serve DNS on, each of
+	// them forwarding external requests or not, e.g. [{"Addr":
+	// "169.254.0.1", "ExternalOn": true}, {"Addr": "172.17.0.1"}] (default
+	// Listener and Port, port Port and ExternalOn unless specified)
+	DNSListeners []ListenAddr
+
+	// HTTPListeners: addresses (ip or ip:port) to serve HTTP on (default
+	// Listener and HttpPort, port HttpPort unless specified)
+	HTTPListeners []string
+
+	// ACLs: networks of the clients allowed to query the Mesos domains,
+	// to have external requests forwarded, to request zone transfers and
+	// to use each route of the HTTP API (default all clients), e.g.
+	// {"Recursion": ["10.0.0.0/8"], "HTTP": {"/v1/config": ["127.0.0.1"]}}
+	ACLs ACLs
+
+	// RateLimits: limits of the requests of each client and of the UDP
+	// responses to each network (RRL), by zone: the domain of a cluster or
+	// a stub zone, or "." for the forwarded requests (default no limits)
+	RateLimits map[string]RateLimit
+
+	// QueryLog: log of the queries, as lines of JSON, to a file or to
+	// stdout (default disabled)
+	QueryLog QueryLog
+
+	// TaskNames: templates of the names of the A and SRV records of each
+	// task (default ["{name}.{framework}"])
+	TaskNames []string
+
+	// TaskHostName: template of the unique name of each task, used as the
+	// target of its SRV records (default "{name}-{hash}-{slave}.{framework}")
+	TaskHostName string
+
+	// MultiLabelNames: split task names at their dots into multiple labels
+	// of up to 63 characters each, instead of a single DNS952 label
+	MultiLabelNames bool
+
+	// LabelSpec: rules used to turn names into labels, "rfc952" for labels
+	// of up to 24 characters starting with a letter or "rfc1123" for labels
+	// of up to 63 characters starting with a letter or digit (default "rfc952")
+	LabelSpec string
+
+	// FrameworkSRV: priority and weight of the SRV records of the tasks of
+	// each framework, by framework name. Tasks can override them with their
+	// DNS_PRIORITY and DNS_WEIGHT labels (default 0 and 0)
+	FrameworkSRV map[string]SRVPriority
+
+	// AnswerOrder: order of the answers to queries in the Mesos domain,
+	// "random", "roundrobin" or "none" (default "random")
+	AnswerOrder string
+
+	// TXTLabels: keys of the task labels included in the TXT records of
+	// each task, along with its task, slave and framework ids
+	TXTLabels []string
+
+	// StateStream: subscribe to the event stream of the leading master
+	// (Mesos 1.1 or later) to update the records as soon as tasks change,
+	// polling every RefreshSeconds while the stream is unavailable
+	StateStream bool
+
+	// MaxStaleness: how long in seconds the last records are served while
+	// the masters can't be reached, before answering SERVFAIL (default 0,
+	// forever)
+	MaxStaleness int
+
+	// StaleTTL: the TTL of the answers while the records are stale, if
+	// lower than their own (default 0, their own TTL)
+	StaleTTL int32
+
+	// SnapshotDir: a directory to save the records of every cluster to
+	// whenever they change, and to load them from at startup until they
+	// are reloaded
+	SnapshotDir string
+
+	// StateFile: a state.json file to load the state from instead of the
+	// mesos masters, e.g. a snapshot exported from a master
+	StateFile string
+
+	// ZoneDir: a directory of zone files (*.zone) to load the records from
+	// instead of the mesos masters
+	ZoneDir string
+
+	// StaticRecords: records in zone file format added to the generated
+	// ones, e.g. "registry IN A 10.0.0.5", relative names are within Domain
+	StaticRecords []string
+
+	// StaticZoneFile: a zone file of records added to the generated ones
+	StaticZoneFile string
+	// the records of StaticRecords and StaticZoneFile, parsed once by
+	// SetConfig
+	static []dns.RR
+
+	// StaticConflict: rule for static records with the same name and type
+	// as generated ones, "override", "merge" or "skip" (default "override")
+	StaticConflict string
+
+	// Aliases: CNAME records from alias to target, both relative to Domain
+	// unless they end with a dot, e.g. {"registry": "docker-registry.marathon"}
+	Aliases map[string]string
+
+	// Clusters: more Mesos clusters served under their own domain, each
+	// with its own masters, Zookeeper, state file or zone directory. They
+	// share the other settings, but for the static records and aliases.
+	Clusters []Cluster
+
+	// StubZones: domains of peer Mesos clusters and the addresses (ip or
+	// ip:port) of their mesos-dns servers, which the queries for these
+	// domains are forwarded to, e.g. {"west.mesos": ["10.1.0.5", "10.1.0.6"]}
+	StubZones map[string][]string
+}
+
+// ListenAddr is an address to serve DNS on
+type ListenAddr struct {
+	Addr string
+	// ExternalOn: forward external requests (default Config.ExternalOn)
+	ExternalOn *bool `json:",omitempty"`
+}
+
+// QueryLog configures the log of the queries
+type QueryLog struct {
+	// File: path of the log, "-" for stdout (default empty, no log)
+	File string
+	// MaxSize: size in megabytes at which the file is rotated, 0 never
+	// rotates it (default 100)
+	MaxSize int
+	// MaxBackups: rotated files kept, named File.1, File.2, etc.
+	// (default 3)
+	MaxBackups int
+	// Sample: one query in Sample is logged (default 1, all of them)
+	Sample int
+}
+
+// RateLimit limits the requests to a zone
+type RateLimit struct {
+	// Requests: requests per second of each client IP, the others are
+	// dropped (default 0, no limit)
+	Requests float64
+	// Burst: requests a client can send at once (default Requests)
+	Burst int
+	// Responses: identical responses per second to each /24 IPv4 or /56
+	// IPv6 network over UDP, the others are dropped (default 0, no limit)
+	Responses float64
+	// Slip: every Slip-th response over the limit is sent truncated
+	// instead of dropped, so that legitimate clients retry over TCP
+	// (default DefaultSlip, 0 drops them all)
+	Slip *int `json:",omitempty"`
+}
+
+// DefaultSlip is the default RateLimit.Slip
+const DefaultSlip = 2
+
+// Cluster is a Mesos cluster served under its own domain
+type Cluster struct {
+	Domain    string
+	Masters   []string
+	Zk        string
+	StateFile string
+	ZoneDir   string
+}
+
+// ClusterConfigs returns the config of every cluster, the one of Domain
+// first. Static records and aliases belong to Domain only.
+func (c Config) ClusterConfigs() []Config {
+	configs := []Config{c}
+	for _, cl := range c.Clusters {
+		cc := c
+		cc.Domain = cl.Domain
+		cc.Masters = cl.Masters
+		cc.Zk = cl.Zk
+		cc.StateFile = cl.StateFile
+		cc.ZoneDir = cl.ZoneDir
+		cc.StaticRecords = nil
+		cc.StaticZoneFile = ""
+		cc.static = nil
+		cc.Aliases = nil
+		cc.Clusters = nil
+		configs = append(configs, cc)
+	}
+	return configs
+}
+
+// normalizeStubZones returns the stub zones with lowercase domains and with
+// the default port 53 added to the addresses of the servers. The domains
+// and addresses must be valid, and the domains can't be served by this
+// instance.
+func (c Config) normalizeStubZones() (map[string][]string, error) {
+	served := map[string]bool{c.Domain: true}
+	for _, cl := range c.Clusters {
+		served[cl.Domain] = true
+	}
+
+	zones := make(map[string][]string, len(c.StubZones))
+	for domain, servers := range c.StubZones {
+		domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+		if _, ok := dns.IsDomainName(domain); !ok || domain == "" {
+			return nil, errors.New("invalid stub zone domain " + domain)
+		}
+		if served[domain] {
+			return nil, errors.New("stub zone " + domain + " is the domain of a cluster")
+		}
+		if len(servers) == 0 {
+			return nil, errors.New("specify the servers of stub zone " + domain)
+		}
+		for _, server := range servers {
+			host, port, err := net.SplitHostPort(server)
+			if err != nil {
+				host, port = server, "53"
+			}
+			if net.ParseIP(host) == nil {
+				return nil, errors.New("invalid server address " + server + " of stub zone " + domain)
+			}
+			zones[domain] = append(zones[domain], net.JoinHostPort(host, port))
+		}
+	}
+	return zones, nil
+}
+
+// normalizeListeners returns the DNS and HTTP listen addresses, as ip:port
+// pairs with the default ports added, and with the default ExternalOn for
+// DNS. Without listen addresses, Listener is listened on.
+func (c Config) normalizeListeners() ([]ListenAddr, []string, error) {
+	dnsAddrs := c.DNSListeners
+	if len(dnsAddrs) == 0 {
+		dnsAddrs = []ListenAddr{{Addr: c.Listener}}
+	}
+	dnsListeners := make([]ListenAddr, 0, len(dnsAddrs))
+	for _, l := range dnsAddrs {
+		addr, err := listenAddr(l.Addr, c.Port)
+		if err != nil {
+			return nil, nil, err
+		}
+		external := c.ExternalOn
+		if l.ExternalOn != nil {
+			external = *l.ExternalOn
+		}
+		dnsListeners = append(dnsListeners, ListenAddr{Addr: addr, ExternalOn: &external})
+	}
+
+	httpAddrs := c.HTTPListeners
+	if len(httpAddrs) == 0 {
+		httpAddrs = []string{c.Listener}
+	}
+	httpListeners := make([]string, 0, len(httpAddrs))
+	for _, a := range httpAddrs {
+		addr, err := listenAddr(a, c.HttpPort)
+		if err != nil {
+			return nil, nil, err
+		}
+		httpListeners = append(httpListeners, addr)
+	}
+	return dnsListeners, httpListeners, nil
+}
+
+// listenAddr returns the ip:port pair of the address to listen on, with
+// port unless it has one. An empty ip listens on all the addresses.
+func listenAddr(addr string, port int) (string, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, p = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), strconv.Itoa(port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return "", errors.New("invalid listen address " + addr)
+	}
+	return net.JoinHostPort(host, p), nil
+}
+
+// normalizeRateLimits returns the rate limits with lowercase zones,
+// checking that they are zones of this instance and that the limits are
+// not negative, and with the default Slip unless specified
+func (c Config) normalizeRateLimits() (map[string]RateLimit, error) {
+	zones := map[string]bool{".": true, c.Domain: true}
+	for _, cl := range c.Clusters {
+		zones[cl.Domain] = true
+	}
+	for domain := range c.StubZones {
+		zones[domain] = true
+	}
+
+	limits := make(map[string]RateLimit, len(c.RateLimits))
+	for zone, limit := range c.RateLimits {
+		if zone != "." {
+			zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+		}
+		if !zones[zone] {
+			return nil, errors.New("rate limit of unknown zone " + zone)
+		}
+		if limit.Requests < 0 || limit.Burst < 0 || limit.Responses < 0 || (limit.Slip != nil && *limit.Slip < 0) {
+			return nil, errors.New("negative rate limit of zone " + zone)
+		}
+		if limit.Slip == nil {
+			slip := DefaultSlip
+			limit.Slip = &slip
+		}
+		limits[zone] = limit
+	}
+	return limits, nil
+}
+
+// validateClusters checks that every cluster has a source of records and a
+// domain of its own. A domain within the domain of another cluster, e.g.
+// east.mesos and mesos, takes its names over.
+func (c Config) validateClusters() error {
+	domains := map[string]bool{c.Domain: true}
+	for _, cl := range c.Clusters {
+		if cl.Domain == "" {
+			return errors.New("specify the domain of every cluster in config.json")
+		}
+		if domains[cl.Domain] {
+			return errors.New("more than one cluster with the domain " + cl.Domain)
+		}
+		domains[cl.Domain] = true
+
+		if len(cl.Masters) == 0 && cl.Zk == "" && cl.StateFile == "" && cl.ZoneDir == "" {
+			return errors.New("specify mesos masters, zookeeper, a state file or a zone directory for cluster " + cl.Domain)
+		}
+		if cl.StateFile != "" && cl.ZoneDir != "" {
+			return errors.New("specify either a state file or a zone directory for cluster " + cl.Domain)
+		}
+	}
+	return nil
 }
 
 // SetConfig instantiates a Config struct read in from config.json
@@ -93,6 +416,12 @@ func SetConfig(cjson string) (c Config) {
 		HttpOn:         true,
 		ExternalOn:     true,
 		RecurseOn:      true,
+		TaskNames:      []string{DefaultTaskName},
+		TaskHostName:   DefaultTaskHostName,
+		LabelSpec:      LabelSpecRFC952,
+		AnswerOrder:    "random",
+		StaticConflict: StaticOverride,
+		QueryLog:       QueryLog{MaxSize: 100, MaxBackups: 3, Sample: 1},
 	}
 
 	// read configuration file
@@ -123,16 +452,103 @@ func SetConfig(cjson string) (c Config) {
 		logging.Error.Println("Either DNS or HTTP server should be on")
 		os.Exit(1)
 	}
-	if len(c.Masters) == 0 && c.Zk == "" {
-		logging.Error.Println("specify mesos masters or zookeeper in config.json")
+	if len(c.Masters) == 0 && c.Zk == "" && c.StateFile == "" && c.ZoneDir == "" {
+		logging.Error.Println("specify mesos masters, zookeeper, a state file or a zone directory in config.json")
+		os.Exit(1)
+	}
+	if c.StateFile != "" && c.ZoneDir != "" {
+		logging.Error.Println("specify either a state file or a zone directory in config.json")
 		os.Exit(1)
 	}
 
-	if c.ExternalOn && len(c.Resolvers) == 0 {
+	if c.DNSListeners, c.HTTPListeners, err = c.normalizeListeners(); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	if err := c.ACLs.validate(); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	external := false
+	for _, l := range c.DNSListeners {
+		external = external || *l.ExternalOn
+	}
+	if external && len(c.Resolvers) == 0 {
 		c.Resolvers = GetLocalDNS()
 	}
 
 	c.Domain = strings.ToLower(c.Domain)
+	for i := range c.Clusters {
+		c.Clusters[i].Domain = strings.ToLower(strings.TrimSuffix(c.Clusters[i].Domain, "."))
+	}
+	if err := c.validateClusters(); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	if c.StubZones, err = c.normalizeStubZones(); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	if c.RateLimits, err = c.normalizeRateLimits(); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	if c.QueryLog.MaxSize < 0 || c.QueryLog.MaxBackups < 0 || c.QueryLog.Sample < 1 {
+		logging.Error.Println("query log needs a non-negative MaxSize and MaxBackups, and a positive Sample")
+		os.Exit(1)
+	}
+	if file := c.QueryLog.File; file != "" && file != "-" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			logging.Error.Println("cannot open the query log: " + err.Error())
+			os.Exit(1)
+		}
+		f.Close()
+	}
+
+	// record name templates
+	if _, _, err := taskTemplates(c); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	if _, err := getLabelSpec(c); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+	c.LabelSpec = strings.ToLower(c.LabelSpec)
+
+	c.AnswerOrder = strings.ToLower(c.AnswerOrder)
+	switch c.AnswerOrder {
+	case "random", "roundrobin", "none":
+	default:
+		logging.Error.Println("unknown answer order " + c.AnswerOrder)
+		os.Exit(1)
+	}
+
+	// static records
+	c.StaticConflict = strings.ToLower(c.StaticConflict)
+	switch c.StaticConflict {
+	case StaticOverride, StaticMerge, StaticSkip:
+	default:
+		logging.Error.Println("unknown static conflict rule " + c.StaticConflict)
+		os.Exit(1)
+	}
+	if c.static, err = staticRecords(c); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+
+	// aliases, the label spec is valid by now
+	spec, _ := getLabelSpec(c)
+	if _, err := configAliases(c, spec); err != nil {
+		logging.Error.Println(err)
+		os.Exit(1)
+	}
+
+	if c.MaxStaleness < 0 || c.StaleTTL < 0 {
+		logging.Error.Println("maxStaleness and staleTTL can't be negative")
+		os.Exit(1)
+	}
 
 	// SOA record fields
 	c.SOARname = strings.Replace(c.SOARname, "@", ".", -1)
@@ -156,8 +572,16 @@ func SetConfig(cjson string) (c Config) {
 	logging.Verbose.Println("   - Domain: " + c.Domain)
 	logging.Verbose.Println("   - Listener: " + c.Listener)
 	logging.Verbose.Println("   - Port: ", c.Port)
+	for _, l := range c.DNSListeners {
+		logging.Verbose.Println("   - DNSListener: "+l.Addr+", ExternalOn: ", *l.ExternalOn)
+	}
 	logging.Verbose.Println("   - DnsOn: ", c.DnsOn)
 	logging.Verbose.Println("   - TTL: ", c.TTL)
+	logging.Verbose.Println("   - MaxStaleness: ", c.MaxStaleness)
+	logging.Verbose.Println("   - StaleTTL: ", c.StaleTTL)
+	if c.SnapshotDir != "" {
+		logging.Verbose.Println("   - SnapshotDir: " + c.SnapshotDir)
+	}
 	logging.Verbose.Println("   - Timeout: ", c.Timeout)
 	logging.Verbose.Println("   - Resolvers: " + strings.Join(c.Resolvers, ", "))
 	logging.Verbose.Println("   - ExternalOn: ", c.ExternalOn)
@@ -170,7 +594,41 @@ func SetConfig(cjson string) (c Config) {
 	logging.Verbose.Println("   - SOAExpire: ", c.SOAMinttl)
 	logging.Verbose.Println("   - RecurseOn: ", c.RecurseOn)
 	logging.Verbose.Println("   - HttpPort: ", c.HttpPort)
+	logging.Verbose.Println("   - HTTPListeners: " + strings.Join(c.HTTPListeners, ", "))
+	logging.Verbose.Println("   - ACLs: ", c.ACLs)
+	for zone, limit := range c.RateLimits {
+		logging.Verbose.Println("   - RateLimit: "+zone+": ", limit)
+	}
+	if c.QueryLog.File != "" {
+		logging.Verbose.Println("   - QueryLog: ", c.QueryLog)
+	}
 	logging.Verbose.Println("   - HttpOn: ", c.HttpOn)
+	logging.Verbose.Println("   - TaskNames: " + strings.Join(c.TaskNames, ", "))
+	logging.Verbose.Println("   - TaskHostName: " + c.TaskHostName)
+	logging.Verbose.Println("   - MultiLabelNames: ", c.MultiLabelNames)
+	logging.Verbose.Println("   - LabelSpec: " + c.LabelSpec)
+	logging.Verbose.Println("   - FrameworkSRV: ", c.FrameworkSRV)
+	logging.Verbose.Println("   - AnswerOrder: " + c.AnswerOrder)
+	logging.Verbose.Println("   - TXTLabels: " + strings.Join(c.TXTLabels, ", "))
+	logging.Verbose.Println("   - StateStream: ", c.StateStream)
+	if c.StateFile != "" {
+		logging.Verbose.Println("   - StateFile: " + c.StateFile)
+	}
+	if c.ZoneDir != "" {
+		logging.Verbose.Println("   - ZoneDir: " + c.ZoneDir)
+	}
+	logging.Verbose.Println("   - StaticRecords: " + strings.Join(c.StaticRecords, ", "))
+	if c.StaticZoneFile != "" {
+		logging.Verbose.Println("   - StaticZoneFile: " + c.StaticZoneFile)
+	}
+	logging.Verbose.Println("   - StaticConflict: " + c.StaticConflict)
+	logging.Verbose.Println("   - Aliases: ", c.Aliases)
+	for _, cl := range c.Clusters {
+		logging.Verbose.Println("   - Cluster: " + cl.Domain)
+	}
+	for domain, servers := range c.StubZones {
+		logging.Verbose.Println("   - StubZone: " + domain + ": " + strings.Join(servers, ", "))
+	}
 	logging.Verbose.Println("   - ConfigFile: ", c.File)
 
 	return c
@@ -14,3 +14,143 @@ func TestNonLocalAddies(t *testing.T) {
 		}
 	}
 }
+
+func TestClusterConfigs(t *testing.T) {
+	c := Config{
+		Domain:        "east.mesos",
+		Masters:       []string{"10.0.0.1:5050"},
+		TTL:           30,
+		StaticRecords: []string{"registry IN A 10.0.0.5"},
+		Clusters: []Cluster{
+			{Domain: "west.mesos", Zk: "zk://10.1.0.1:2181/mesos"},
+			{Domain: "batch.mesos", StateFile: "state.json"},
+		},
+	}
+	if err := c.validateClusters(); err != nil {
+		t.Fatal(err)
+	}
+
+	configs := c.ClusterConfigs()
+	if len(configs) != 3 || configs[0].Domain != "east.mesos" {
+		t.Fatalf("expected the config of Domain and of each cluster instead of %v", configs)
+	}
+	west := configs[1]
+	if west.Domain != "west.mesos" || west.Zk != c.Clusters[0].Zk || len(west.Masters) != 0 || west.TTL != 30 {
+		t.Errorf("unexpected config of a cluster %+v", west)
+	}
+	if len(west.StaticRecords) != 0 || len(west.Clusters) != 0 {
+		t.Error("should keep the static records to Domain")
+	}
+
+	for _, clusters := range [][]Cluster{
+		{{Domain: "west.mesos"}},
+		{{Domain: "", Zk: "zk://10.1.0.1:2181/mesos"}},
+		{{Domain: "east.mesos", Zk: "zk://10.1.0.1:2181/mesos"}},
+		{{Domain: "west.mesos", Zk: "zk://10.1.0.1:2181/mesos"}, {Domain: "west.mesos", StateFile: "state.json"}},
+		{{Domain: "west.mesos", StateFile: "state.json", ZoneDir: "zones"}},
+	} {
+		c.Clusters = clusters
+		if err := c.validateClusters(); err == nil {
+			t.Errorf("expected an error for the clusters %+v", clusters)
+		}
+	}
+}
+
+func TestNormalizeStubZones(t *testing.T) {
+	c := Config{
+		Domain:   "east.mesos",
+		Clusters: []Cluster{{Domain: "batch.mesos"}},
+		StubZones: map[string][]string{
+			"West.Mesos.": {"10.1.0.5", "10.1.0.6:5353"},
+		},
+	}
+	zones, err := c.normalizeStubZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if servers := zones["west.mesos"]; len(servers) != 2 || servers[0] != "10.1.0.5:53" || servers[1] != "10.1.0.6:5353" {
+		t.Errorf("unexpected stub zones %v", zones)
+	}
+
+	for _, stubs := range []map[string][]string{
+		{"batch.mesos": {"10.1.0.5"}},
+		{"west.mesos": {}},
+		{"west.mesos": {"ns1.west.mesos"}},
+	} {
+		c.StubZones = stubs
+		if _, err := c.normalizeStubZones(); err == nil {
+			t.Errorf("expected an error for the stub zones %v", stubs)
+		}
+	}
+}
+
+func TestNormalizeListeners(t *testing.T) {
+	off := false
+	c := Config{
+		Listener:   "0.0.0.0",
+		Port:       53,
+		HttpPort:   8123,
+		ExternalOn: true,
+	}
+	dnsListeners, httpListeners, err := c.normalizeListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dnsListeners) != 1 || dnsListeners[0].Addr != "0.0.0.0:53" || !*dnsListeners[0].ExternalOn {
+		t.Errorf("expected to listen on Listener by default instead of %v", dnsListeners)
+	}
+	if len(httpListeners) != 1 || httpListeners[0] != "0.0.0.0:8123" {
+		t.Errorf("expected to serve HTTP on Listener by default instead of %v", httpListeners)
+	}
+
+	c.DNSListeners = []ListenAddr{{Addr: "169.254.0.1"}, {Addr: "172.17.0.1:5353", ExternalOn: &off}, {Addr: "::1"}}
+	c.HTTPListeners = []string{"127.0.0.1", "[::1]:8080"}
+	if dnsListeners, httpListeners, err = c.normalizeListeners(); err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"169.254.0.1:53", "172.17.0.1:5353", "[::1]:53"} {
+		if dnsListeners[i].Addr != want || *dnsListeners[i].ExternalOn != (i != 1) {
+			t.Errorf("expected DNS listener %s instead of %s, %v", want, dnsListeners[i].Addr, *dnsListeners[i].ExternalOn)
+		}
+	}
+	if len(httpListeners) != 2 || httpListeners[0] != "127.0.0.1:8123" || httpListeners[1] != "[::1]:8080" {
+		t.Errorf("unexpected HTTP listeners %v", httpListeners)
+	}
+
+	c.HTTPListeners = []string{"localhost:8123"}
+	if _, _, err = c.normalizeListeners(); err == nil {
+		t.Error("expected an error for a host name")
+	}
+}
+
+func TestNormalizeRateLimits(t *testing.T) {
+	zero, negative := 0, -1
+	c := Config{
+		Domain:    "mesos",
+		Clusters:  []Cluster{{Domain: "east.mesos"}},
+		StubZones: map[string][]string{"west.mesos": {"10.1.0.5:53"}},
+		RateLimits: map[string]RateLimit{
+			"East.Mesos.": {Requests: 100},
+			".":           {Responses: 5},
+			"west.mesos":  {Requests: 10, Burst: 20, Slip: &zero},
+		},
+	}
+	limits, err := c.normalizeRateLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 3 || limits["east.mesos"].Requests != 100 || *limits["."].Slip != DefaultSlip || limits["west.mesos"].Burst != 20 || *limits["west.mesos"].Slip != 0 {
+		t.Errorf("unexpected rate limits %v", limits)
+	}
+
+	for _, rl := range []map[string]RateLimit{
+		{"example.com": {Requests: 10}},
+		{"mesos": {Requests: -1}},
+		{"mesos": {Responses: 1, Slip: &negative}},
+	} {
+		c.RateLimits = rl
+		if _, err := c.normalizeRateLimits(); err == nil {
+			t.Errorf("expected an error for the rate limits %v", rl)
+		}
+	}
+}
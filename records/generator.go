@@ -9,6 +9,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -16,19 +17,43 @@ import (
 	"github.com/mesosphere/mesos-dns/records/labels"
 )
 
-// Map host/service name to DNS answer
-// REFACTOR - when discoveryinfo is integrated
-// Will likely become map[string][]discoveryinfo
-type rrs map[string][]string
-
 // Mesos-DNS state
 // Refactor when discovery id is available
 type RecordGenerator struct {
-	As     rrs
-	SRVs   rrs
-	Slaves map[string]string
+	// Records holds the records of every name in the domain by type. The
+	// parents of names with records (e.g. marathon.mesos. for
+	// app.marathon.mesos.) have an empty RRSet, so that they exist even
+	// without records.
+	Records map[string]RRSet
+	Slaves  map[string]string
+
+	// children maps every name in Records and the domain to their
+	// children in Records, used to match wildcards
+	children map[string][]string
+
+	// ttl of the generated records
+	ttl uint32
+
+	// keys of the inserted records, to skip duplicates while generating
+	keys map[string]struct{}
+
+	// hash of the records, see Hash
+	hash string
+}
+
+// SRVPriority holds the priority and weight of a SRV record
+type SRVPriority struct {
+	Priority uint16
+	Weight   uint16
 }
 
+// Task labels overriding the priority and weight of the SRV records of a
+// task
+const (
+	PriorityLabel = "DNS_PRIORITY"
+	WeightLabel   = "DNS_WEIGHT"
+)
+
 // The following types help parse state.json
 // Resources holds our SRV ports
 type Resources struct {
@@ -43,18 +68,29 @@ type Tasks []struct {
 	SlaveId     string `json:"slave_id"`
 	State       string `json:"state"`
 	Resources   `json:"resources"`
+	Labels      []Label `json:"labels"`
+}
+
+// Label holds a key/value task label read in from state.json
+type Label struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
 // Frameworks holds mesos frameworks information read in from state.json
 type Frameworks []struct {
-	Tasks `json:"tasks"`
-	Name  string `json:"name"`
+	Tasks    `json:"tasks"`
+	Name     string `json:"name"`
+	Role     string `json:"role"`
+	Hostname string `json:"hostname"`
+	WebUIURL string `json:"webui_url"`
 }
 
 // Slaves is a mapping of id to hostname read in from state.json
 type slave struct {
 	Id       string `json:"id"`
 	Hostname string `json:"hostname"`
+	Pid      string `json:"pid"`
 }
 type Slaves []slave
 
@@ -81,8 +117,7 @@ func (rg *RecordGenerator) ParseState(leader string, c Config) error {
 	}
 
 	// insert state
-	rg.InsertState(sj, c.Domain, c.SOARname, c.Listener, c.Masters)
-	return nil
+	return rg.InsertState(sj, c)
 }
 
 // Tries each master and looks for the leader
@@ -200,31 +235,54 @@ func hashString(s string) string {
 }
 
 // InsertState transforms a StateJSON into RecordGenerator RRs
-func (rg *RecordGenerator) InsertState(sj StateJSON, domain string, ns string,
-	listener string, masters []string) error {
+func (rg *RecordGenerator) InsertState(sj StateJSON, c Config) error {
+	return rg.insertState(sj, c, hostToIP4)
+}
+
+// InsertStateCached is InsertState resolving the host names of the slaves
+// and frameworks through hosts, which keeps their addresses for the next
+// state. It isn't safe for concurrent use with the same hosts.
+func (rg *RecordGenerator) InsertStateCached(sj StateJSON, c Config, hosts *HostCache) error {
+	hosts.next = make(map[string]string, len(hosts.ips))
+	err := rg.insertState(sj, c, hosts.resolve)
+	hosts.ips, hosts.next = hosts.next, nil
+	return err
+}
+
+// insertState is InsertState with the host names resolved by resolve
+func (rg *RecordGenerator) insertState(sj StateJSON, c Config, resolve func(string) (string, bool)) error {
+	tnames, thost, err := taskTemplates(c)
+	if err != nil {
+		return err
+	}
+	spec, err := getLabelSpec(c)
+	if err != nil {
+		return err
+	}
+	aliases, err := configAliases(c, spec)
+	if err != nil {
+		return err
+	}
+	static := c.static
+	if static == nil {
+		if static, err = staticRecords(c); err != nil {
+			return err
+		}
+	}
+	domain := c.Domain
+	origins := make(nameOrigins)
 
 	// creates a map with slave IP addresses (IPv4)
 	rg.Slaves = make(map[string]string)
 	for _, slave := range sj.Slaves {
-		// if slave is a hostname, translate it
-		if net.ParseIP(slave.Hostname) == nil {
-			t, err := net.ResolveIPAddr("ip4", slave.Hostname)
-			if err != nil {
-				logging.Error.Println("cannot translate hostname " + slave.Hostname)
-			}
-			rg.Slaves[slave.Id] = t.IP.String()
-		} else {
-			rg.Slaves[slave.Id] = slave.Hostname
+		if ip, ok := resolve(slave.Hostname); ok {
+			rg.Slaves[slave.Id] = ip
 		}
 	}
 
-	rg.SRVs = make(rrs)
-	rg.As = make(rrs)
+	rg.init(c)
 
-	// complete crap - refactor me
 	for _, f := range sj.Frameworks {
-		fname := labels.AsDomainFrag(f.Name)
-
 		for _, task := range f.Tasks {
 			host, ok := rg.Slaves[task.SlaveId]
 			// skip not running or not discoverable tasks
@@ -232,36 +290,202 @@ func (rg *RecordGenerator) InsertState(sj StateJSON, domain string, ns string,
 				continue
 			}
 
-			tname := labels.AsDNS952(task.Name)
-			sid := slaveIdTail(task.SlaveId)
-			tag := hashString(task.Id)
-			tail := fname + "." + domain + "."
+			n := &taskNaming{
+				name:      task.Name,
+				framework: f.Name,
+				slave:     slaveIdTail(task.SlaveId),
+				hash:      hashString(task.Id),
+				role:      f.Role,
+				labels:    make(map[string]string, len(task.Labels)),
+
+				spec:       spec,
+				multiLabel: c.MultiLabelNames,
+			}
+			for _, l := range task.Labels {
+				n.labels[l.Key] = l.Value
+			}
+			owner := &Owner{
+				TaskID:      task.Id,
+				TaskName:    task.Name,
+				SlaveID:     task.SlaveId,
+				FrameworkID: task.FrameworkId,
+				Framework:   f.Name,
+			}
 
-			// A records for task and task-sid
-			arec := tname + "." + tail
-			rg.insertRR(arec, host, "A")
-			trec := tname + "-" + tag + "-" + sid + "." + tail
-			rg.insertRR(trec, host, "A")
+			// A record for task-sid, the target of the SRV records
+			tname, err := thost.expand(n)
+			if err != nil {
+				logging.VeryVerbose.Println("Warning: skipping task " + task.Id + ": " + err.Error())
+				continue
+			}
+			trec, err := fqdn(tname, domain)
+			if err != nil || !origins.claim(trec, thost.origin(n)) {
+				continue
+			}
+			rg.insertA(trec, host, owner)
+			txt := taskTXT(task.Id, task.SlaveId, task.FrameworkId, task.Labels, c.TXTLabels)
+			rg.insertTXT(trec, txt, owner)
 
-			// SRV records
+			var ports []string
 			if task.Resources.Ports != "" {
-				ports := yankPorts(task.Resources.Ports)
+				ports = yankPorts(task.Resources.Ports)
+			}
+			prio := taskSRVPriority(n.labels, c.FrameworkSRV[f.Name])
+
+			// aliases point at the first name of the task
+			target := ""
+			for _, t := range tnames {
+				name, err := t.expand(n)
+				if err != nil {
+					logging.VeryVerbose.Println("Warning: skipping name for task " + task.Id + ": " + err.Error())
+					continue
+				}
+
+				// A records for task
+				arec, err := fqdn(name, domain)
+				if err != nil {
+					logging.VeryVerbose.Println("Warning: skipping name for task " + task.Id + ": " + err.Error())
+					continue
+				}
+				if !origins.claim(arec, t.origin(n)) {
+					continue
+				}
+				rg.insertA(arec, host, owner)
+				rg.insertTXT(arec, txt, owner)
+				if target == "" {
+					target = arec
+				}
+
+				// SRV records for the first label of the task name
+				service, tail := name, ""
+				if i := strings.Index(name, "."); i != -1 {
+					service, tail = name[:i], name[i:]
+				}
+				tcp := "_" + service + "._tcp" + tail + "." + domain + "."
+				udp := "_" + service + "._udp" + tail + "." + domain + "."
 				for _, port := range ports {
-					var srvhost string = trec + ":" + port
-					tcp := "_" + tname + "._tcp." + tail
-					udp := "_" + tname + "._udp." + tail
-					rg.insertRR(tcp, srvhost, "SRV")
-					rg.insertRR(udp, srvhost, "SRV")
+					rg.insertSRV(tcp, trec, port, prio, owner)
+					rg.insertSRV(udp, trec, port, prio, owner)
 				}
 			}
+			if target == "" {
+				target = trec
+			}
+			aliases = append(aliases, taskAliases(n, domain, target, owner)...)
 		}
 	}
 
-	rg.listenerRecord(listener, ns)
-	rg.masterRecord(domain, masters, sj.Leader)
+	rg.frameworkRecords(sj, domain, spec, origins, resolve)
+	rg.slaveRecords(sj, domain)
+	rg.listenerRecord(c.Listener, c.SOARname)
+	rg.masterRecord(domain, c.Masters, sj.Leader)
+	rg.insertAliases(aliases, origins)
+	rg.insertStatic(static, c.StaticConflict)
+	rg.finish(domain)
 	return nil
 }
 
+// taskTXT returns the character strings of the TXT record of a task, its
+// ids and the labels in the allowed list as key=value strings
+func taskTXT(id, slaveId, frameworkId string, tlabels []Label, allowed []string) []string {
+	txt := []string{"task_id=" + id, "slave_id=" + slaveId, "framework_id=" + frameworkId}
+	for _, key := range allowed {
+		for _, l := range tlabels {
+			if l.Key == key {
+				txt = append(txt, l.Key+"="+l.Value)
+			}
+		}
+	}
+
+	// a character string is at most 255 bytes long
+	valid := txt[:0]
+	for _, s := range txt {
+		if len(s) > 255 {
+			logging.VeryVerbose.Println("Warning: skipping TXT string longer than 255 bytes " + s[:255])
+			continue
+		}
+		valid = append(valid, s)
+	}
+	return valid
+}
+
+// taskSRVPriority returns the priority and weight of the SRV records of a
+// task, from its labels or else from the default of its framework
+func taskSRVPriority(tlabels map[string]string, prio SRVPriority) SRVPriority {
+	parse := func(key string, v *uint16) {
+		s, ok := tlabels[key]
+		if !ok {
+			return
+		}
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			logging.Error.Printf("invalid %s label %q: %v", key, s, err)
+			return
+		}
+		*v = uint16(n)
+	}
+	parse(PriorityLabel, &prio.Priority)
+	parse(WeightLabel, &prio.Weight)
+	return prio
+}
+
+// A and SRV records for the framework schedulers
+// the address is taken from webui_url, falling back to the hostname
+func (rg *RecordGenerator) frameworkRecords(sj StateJSON, domain string, spec *labelSpec, origins nameOrigins, resolve func(string) (string, bool)) {
+	for _, f := range sj.Frameworks {
+		fname := labels.DomainFrag(f.Name, spec.label)
+		if fname == "" {
+			continue
+		}
+
+		host, port := f.Hostname, ""
+		if u, err := url.Parse(f.WebUIURL); err == nil && u.Host != "" {
+			if h, p, err := net.SplitHostPort(u.Host); err == nil {
+				host, port = h, p
+			} else {
+				host = u.Host
+			}
+		}
+
+		ip, ok := resolve(host)
+		if !ok {
+			continue
+		}
+
+		arec, err := fqdn(fname, domain)
+		if err != nil || !origins.claim(arec, strings.ToLower(f.Name)) {
+			continue
+		}
+		rg.insertA(arec, ip, nil)
+		if port != "" {
+			rg.insertSRV("_framework._tcp."+arec, arec, port, SRVPriority{}, nil)
+		}
+	}
+}
+
+// A and SRV records for the slaves, both for all of them (slave.domain)
+// and for each one by its id (slaveid.slave.domain)
+func (rg *RecordGenerator) slaveRecords(sj StateJSON, domain string) {
+	arec := "slave." + domain + "."
+	for _, slave := range sj.Slaves {
+		ip, ok := rg.Slaves[slave.Id]
+		if !ok {
+			continue
+		}
+		rg.insertA(arec, ip, nil)
+
+		// slave ids start with digits, which only RFC1123 allows
+		srec := labels.AsRFC1123(slave.Id) + "." + arec
+		rg.insertA(srec, ip, nil)
+
+		// the slave port comes from its libprocess pid, slave(1)@ip:port
+		if i := strings.LastIndex(slave.Pid, ":"); i != -1 && i < len(slave.Pid)-1 {
+			port := slave.Pid[i+1:]
+			rg.insertSRV("_slave._tcp."+domain+".", srec, port, SRVPriority{}, nil)
+		}
+	}
+}
+
 // A records for the mesos masters
 func (rg *RecordGenerator) masterRecord(domain string, masters []string, leader string) {
 	// create records for leader
@@ -275,15 +499,15 @@ func (rg *RecordGenerator) masterRecord(domain string, masters []string, leader
 		logging.Error.Println(err)
 	}
 	arec := "leader." + domain + "."
-	rg.insertRR(arec, ip, "A")
+	rg.insertA(arec, ip, nil)
 	arec = "master." + domain + "."
-	rg.insertRR(arec, ip, "A")
+	rg.insertA(arec, ip, nil)
 	// SRV records
 	tcp := "_leader._tcp." + domain + "."
 	udp := "_leader._udp." + domain + "."
-	host := "leader." + domain + "." + ":" + port
-	rg.insertRR(tcp, host, "SRV")
-	rg.insertRR(udp, host, "SRV")
+	host := "leader." + domain + "."
+	rg.insertSRV(tcp, host, port, SRVPriority{}, nil)
+	rg.insertSRV(udp, host, port, SRVPriority{}, nil)
 
 	// if there is a list of masters, insert that as well
 	for i, master := range masters {
@@ -300,9 +524,9 @@ func (rg *RecordGenerator) masterRecord(domain string, masters []string, leader
 
 		// A records (master and masterN)
 		arec := "master." + domain + "."
-		rg.insertRR(arec, ip, "A")
+		rg.insertA(arec, ip, nil)
 		arec = "master" + strconv.Itoa(i) + "." + domain + "."
-		rg.insertRR(arec, ip, "A")
+		rg.insertA(arec, ip, nil)
 	}
 }
 
@@ -311,9 +535,9 @@ func (rg *RecordGenerator) listenerRecord(listener string, ns string) {
 	if listener == "0.0.0.0" {
 		rg.setFromLocal(listener, ns)
 	} else if listener == "127.0.0.1" {
-		rg.insertRR(ns, "127.0.0.1", "A")
+		rg.insertA(ns, "127.0.0.1", nil)
 	} else {
-		rg.insertRR(ns, listener, "A")
+		rg.insertA(ns, listener, nil)
 	}
 }
 
@@ -353,42 +577,54 @@ func (rg *RecordGenerator) setFromLocal(host string, ns string) {
 				continue
 			}
 
-			rg.insertRR(ns, ip.String(), "A")
+			rg.insertA(ns, ip.String(), nil)
 		}
 	}
 }
 
-// insertRR inserts host to name's map
-// REFACTOR when storage is updated
-func (rg *RecordGenerator) insertRR(name string, host string, rtype string) {
-	logging.VeryVerbose.Println("[" + rtype + "]\t" + name + ": " + host)
-
-	if rtype == "A" {
-		if val, ok := rg.As[name]; ok {
-			// check if A record already exists
-			// identical tasks on same slave
-			for _, b := range val {
-				if b == host {
-					return
-				}
-			}
-			rg.As[name] = append(val, host)
-		} else {
-			rg.As[name] = []string{host}
+// hostToIP4 returns the IPv4 address of host, translating it if it is a
+// hostname
+func hostToIP4(host string) (string, bool) {
+	if host == "" {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip = ip.To4(); ip == nil {
+			return "", false
 		}
-	} else {
-		if val, ok := rg.SRVs[name]; ok {
-			// check if SRV record already exists
-			for _, b := range val {
-				if b == host {
-					return
-				}
-			}
-			rg.SRVs[name] = append(val, host)
-		} else {
-			rg.SRVs[name] = []string{host}
+		return ip.String(), true
+	}
+	t, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		logging.Error.Println("cannot translate hostname " + host)
+		return "", false
+	}
+	return t.IP.String(), true
+}
+
+// HostCache keeps the IPv4 addresses of host names between states, see
+// InsertStateCached. Names that don't resolve are tried again with every
+// state, and names no longer in the state are forgotten.
+type HostCache struct {
+	ips  map[string]string
+	next map[string]string // the names of the state being inserted
+}
+
+// NewHostCache returns an empty HostCache
+func NewHostCache() *HostCache {
+	return &HostCache{ips: make(map[string]string)}
+}
+
+// resolve returns the cached address of host, resolving it the first time
+func (hc *HostCache) resolve(host string) (string, bool) {
+	ip, ok := hc.ips[host]
+	if !ok {
+		if ip, ok = hostToIP4(host); !ok {
+			return "", false
 		}
 	}
+	hc.next[host] = ip
+	return ip, true
 }
 
 // returns an array of ports from a range
@@ -5,6 +5,8 @@ import (
 	"github.com/mesosphere/mesos-dns/logging"
 	"io/ioutil"
 	"testing"
+
+	"github.com/miekg/dns"
 )
 
 func init() {
@@ -13,6 +15,16 @@ func init() {
 	logging.SetupLogs()
 }
 
+// fakeConfig returns the config used to insert ../factories/fake.json
+func fakeConfig() Config {
+	return Config{
+		Domain:   "mesos",
+		SOARname: "mesos-dns.mesos.",
+		Listener: "127.0.0.1",
+		Masters:  []string{"144.76.157.37:5050"},
+	}
+}
+
 func TestYankPorts(t *testing.T) {
 	p := "[31328-31328]"
 
@@ -90,89 +102,256 @@ func TestInsertState(t *testing.T) {
 	}
 	sj.Leader = "master@144.76.157.37:5050"
 
-	masters := []string{"144.76.157.37:5050"}
 	rg := RecordGenerator{}
-	rg.InsertState(sj, "mesos", "mesos-dns.mesos.", "127.0.0.1", masters)
+	rg.InsertState(sj, fakeConfig())
 
 	// ensure we are only collecting running tasks
-	_, ok := rg.SRVs["_poseidon._tcp.marathon.mesos."]
-	if ok {
+	if len(rg.Lookup("_poseidon._tcp.marathon.mesos.", dns.TypeSRV)) != 0 {
 		t.Error("should not find this not-running task - SRV record")
 	}
 
-	_, ok = rg.As["liquor-store.marathon.mesos."]
-	if !ok {
+	if len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA)) == 0 {
 		t.Error("should find this running task - A record")
 	}
 
-	_, ok = rg.As["poseidon.marathon.mesos."]
-	if ok {
+	if len(rg.Lookup("poseidon.marathon.mesos.", dns.TypeA)) != 0 {
 		t.Error("should not find this not-running task - A record")
 	}
 
-	_, ok = rg.As["master.mesos."]
-	if !ok {
+	if len(rg.Lookup("master.mesos.", dns.TypeA)) == 0 {
 		t.Error("should find a running master - A record")
 	}
 
-	_, ok = rg.As["master0.mesos."]
-	if !ok {
+	if len(rg.Lookup("master0.mesos.", dns.TypeA)) == 0 {
 		t.Error("should find a running master0 - A record")
 	}
 
-	_, ok = rg.As["leader.mesos."]
-	if !ok {
+	if len(rg.Lookup("leader.mesos.", dns.TypeA)) == 0 {
 		t.Error("should find a leading master - A record")
 	}
 
-	_, ok = rg.SRVs["_leader._tcp.mesos."]
-	if !ok {
+	if len(rg.Lookup("_leader._tcp.mesos.", dns.TypeSRV)) == 0 {
 		t.Error("should find a leading master - SRV record")
 	}
 
-	// test for 10 SRV names
-	if len(rg.SRVs) != 10 {
+	// test for 12 SRV names
+	if countNames(&rg, dns.TypeSRV) != 12 {
 		t.Error("not enough SRVs")
 	}
 
-	// test for 5 A names
-	if len(rg.As) != 13 {
+	// test for 19 A names
+	if countNames(&rg, dns.TypeA) != 19 {
 		t.Error("not enough As")
 	}
 
 	// ensure we translate the framework name as well
-	_, ok = rg.As["some-box.chronoswithaspaceandmixe.mesos."]
-	if !ok {
+	if len(rg.Lookup("some-box.chronoswithaspaceandmixe.mesos.", dns.TypeA)) == 0 {
 		t.Error("should find this task w/a space in the framework name - A record")
 	}
 
 	// ensure we find this SRV
-	rrs := rg.SRVs["_liquor-store._tcp.marathon.mesos."]
+	rrs := rg.Lookup("_liquor-store._tcp.marathon.mesos.", dns.TypeSRV)
 	// ensure there are 3 RRDATA answers for this SRV name
 	if len(rrs) != 3 {
 		t.Error("not enough SRV records")
 	}
 
 	// ensure we don't find this as a SRV record
-	rrs = rg.SRVs["_liquor-store.marathon.mesos."]
+	rrs = rg.Lookup("_liquor-store.marathon.mesos.", dns.TypeSRV)
 	if len(rrs) != 0 {
 		t.Error("not a proper SRV record")
 	}
 
+	// ensure we find the framework scheduler
+	rrs = rg.Lookup("marathon.mesos.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].RR.(*dns.A).A.String() != "1.2.3.11" || rrs[0].Owner != nil {
+		t.Error("should find the marathon scheduler - A record")
+	}
+
+	rrs = rg.Lookup("_framework._tcp.marathon.mesos.", dns.TypeSRV)
+	if len(rrs) != 1 || rrs[0].RR.(*dns.SRV).Target != "marathon.mesos." || rrs[0].RR.(*dns.SRV).Port != 8080 {
+		t.Error("should find the marathon scheduler - SRV record")
+	}
+
+	// ensure we find all the slaves and each one by id
+	rrs = rg.Lookup("slave.mesos.", dns.TypeA)
+	if len(rrs) != 3 {
+		t.Error("should find all the slaves - A record")
+	}
+
+	rrs = rg.Lookup("20140827-000744-3041283216-5050-2116-1.slave.mesos.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].RR.(*dns.A).A.String() != "1.2.3.12" {
+		t.Error("should find a slave by id - A record")
+	}
+
+	rrs = rg.Lookup("_slave._tcp.mesos.", dns.TypeSRV)
+	if len(rrs) != 3 {
+		t.Error("should find all the slaves - SRV record")
+	}
+
+	// ensure names without records of their own exist
+	for _, name := range []string{"_tcp.marathon.mesos.", "_liquor-store._tcp.marathon.mesos.", "slave.mesos."} {
+		if !rg.Exists(name) {
+			t.Errorf("should find name %s", name)
+		}
+	}
+	for _, name := range []string{"mesos.", "_tcp.mesos.marathon.mesos.", "poseidon.marathon.mesos."} {
+		if rg.Exists(name) {
+			t.Errorf("should not find name %s", name)
+		}
+	}
 }
 
 // ensure we only generate one A record for each host
 func TestNTasks(t *testing.T) {
 	rg := RecordGenerator{}
-	rg.As = make(rrs)
+	rg.Records = make(map[string]RRSet)
+	rg.keys = make(map[string]struct{})
 
-	rg.insertRR("blah.mesos", "10.0.0.1", "A")
-	rg.insertRR("blah.mesos", "10.0.0.1", "A")
-	rg.insertRR("blah.mesos", "10.0.0.2", "A")
+	rg.insertA("blah.mesos", "10.0.0.1", nil)
+	rg.insertA("blah.mesos", "10.0.0.1", nil)
+	rg.insertA("blah.mesos", "10.0.0.2", nil)
 
-	k, _ := rg.As["blah.mesos"]
+	k := rg.Lookup("blah.mesos", dns.TypeA)
 
 	if len(k) != 2 {
 		t.Error("should only have 2 A records")
 	}
 }
+
+func TestTaskSRVPriority(t *testing.T) {
+	fprio := SRVPriority{Priority: 10, Weight: 5}
+
+	if prio := taskSRVPriority(nil, SRVPriority{}); prio != (SRVPriority{}) {
+		t.Error("should not find a priority without labels or framework default")
+	}
+
+	prio := taskSRVPriority(nil, fprio)
+	if prio != fprio {
+		t.Error("should fall back to the framework default")
+	}
+
+	tlabels := map[string]string{PriorityLabel: "20", WeightLabel: "1"}
+	prio = taskSRVPriority(tlabels, fprio)
+	if prio != (SRVPriority{Priority: 20, Weight: 1}) {
+		t.Error("should take the priority and weight from the task labels")
+	}
+
+	tlabels = map[string]string{WeightLabel: "not-a-number"}
+	prio = taskSRVPriority(tlabels, fprio)
+	if prio != fprio {
+		t.Error("should ignore invalid labels")
+	}
+}
+
+func TestInsertStateSRVPriority(t *testing.T) {
+	sj := fakeTasksState("liquor-store")
+	sj.Frameworks[0].Tasks[0].Resources.Ports = "[31354-31354]"
+
+	c := fakeConfig()
+	c.FrameworkSRV = map[string]SRVPriority{"marathon": {Priority: 1, Weight: 2}}
+
+	rg := RecordGenerator{}
+	if err := rg.InsertState(sj, c); err != nil {
+		t.Fatal(err)
+	}
+
+	srvs := rg.Lookup("_liquor-store._tcp.marathon.mesos.", dns.TypeSRV)
+	if len(srvs) != 1 {
+		t.Fatal("should find the task - SRV record")
+	}
+	srv := srvs[0].RR.(*dns.SRV)
+	if prio := (SRVPriority{srv.Priority, srv.Weight}); prio != c.FrameworkSRV["marathon"] {
+		t.Errorf("expected the framework priority instead of %+v", prio)
+	}
+}
+
+func TestInsertStateCached(t *testing.T) {
+	sj := fakeTasksState("liquor-store")
+	sj.Slaves[0].Hostname = "agent-1.invalid"
+
+	// cached names aren't resolved again
+	hosts := NewHostCache()
+	hosts.ips["agent-1.invalid"] = "10.1.2.3"
+	rg := RecordGenerator{}
+	if err := rg.InsertStateCached(sj, fakeConfig(), hosts); err != nil {
+		t.Fatal(err)
+	}
+	if a := rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA); len(a) != 1 || a[0].RR.(*dns.A).A.String() != "10.1.2.3" {
+		t.Errorf("should find the cached address of the slave - A record, found %v", a)
+	}
+	if len(hosts.ips) != 2 || hosts.ips["1.2.3.12"] != "1.2.3.12" {
+		t.Errorf("should cache the addresses of the state, found %v", hosts.ips)
+	}
+
+	// names no longer in the state are forgotten
+	sj.Slaves[0].Hostname = "1.2.3.11"
+	rg = RecordGenerator{}
+	if err := rg.InsertStateCached(sj, fakeConfig(), hosts); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hosts.ips["agent-1.invalid"]; ok || len(hosts.ips) != 2 {
+		t.Errorf("should forget the names no longer in the state, found %v", hosts.ips)
+	}
+}
+
+func TestInsertStateTXT(t *testing.T) {
+	sj := fakeTasksState("liquor-store")
+	sj.Frameworks[0].Tasks[0].FrameworkId = "20140703-014514-3041283216-5050-5348-0000"
+	sj.Frameworks[0].Tasks[0].Labels = []Label{
+		{Key: "VERSION", Value: "1.2"},
+		{Key: "SECRET", Value: "hunter2"},
+	}
+
+	c := fakeConfig()
+	c.TXTLabels = []string{"VERSION"}
+
+	rg := RecordGenerator{}
+	if err := rg.InsertState(sj, c); err != nil {
+		t.Fatal(err)
+	}
+
+	txts := rg.Lookup("liquor-store.marathon.mesos.", dns.TypeTXT)
+	if len(txts) != 1 {
+		t.Fatal("should find the task - TXT record")
+	}
+	expected := []string{
+		"task_id=liquor-store.0",
+		"slave_id=20140803-125133-3041283216-5050-2410-0",
+		"framework_id=20140703-014514-3041283216-5050-5348-0000",
+		"VERSION=1.2",
+	}
+	if txt := txts[0].RR.(*dns.TXT).Txt; !equalStrings(txt, expected) {
+		t.Errorf("expected TXT record %q instead of %q", expected, txt)
+	}
+	if owner := txts[0].Owner; owner == nil || owner.TaskID != "liquor-store.0" || owner.Framework != "marathon" {
+		t.Errorf("expected the task to own the TXT record instead of %+v", owner)
+	}
+
+	if countNames(&rg, dns.TypeTXT) != 2 {
+		t.Error("should find a TXT record for the task name and task host name")
+	}
+}
+
+// countNames returns the number of names with records of type qtype
+func countNames(rg *RecordGenerator, qtype uint16) int {
+	n := 0
+	for _, set := range rg.Records {
+		if len(set[qtype]) > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
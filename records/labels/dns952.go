@@ -7,13 +7,13 @@ var dns952table []int32
 func init() {
 	const tolower = int32('a' - 'A')
 	dns952table = make([]int32, 256, 256)
-	for i := int32('A'); i < int32('Z'); i++ {
+	for i := int32('A'); i <= int32('Z'); i++ {
 		dns952table[i] = i + tolower
 	}
-	for i := int32('a'); i < int32('z'); i++ {
+	for i := int32('a'); i <= int32('z'); i++ {
 		dns952table[i] = i
 	}
-	for i := int32('0'); i < int32('9'); i++ {
+	for i := int32('0'); i <= int32('9'); i++ {
 		dns952table[i] = -i
 	}
 	dns952table[int32('-')] = -int32('-')
@@ -26,12 +26,22 @@ func init() {
 //    ^[a-z]([-a-z0-9]*[a-z0-9])?$
 // returns "" if the name cannot be mangled.
 func AsDNS952(name string) string {
+	return asDNS952(name, DNS952MaxLength)
+}
+
+// mangle the given name like AsDNS952 does, but allowing the full
+// LabelMaxLength of a domain name label instead of DNS952MaxLength.
+func AsLabel(name string) string {
+	return asDNS952(name, LabelMaxLength)
+}
+
+func asDNS952(name string, max int) string {
 	if name == "" {
 		return ""
 	}
 	sz := len(name)
-	if sz > DNS952MaxLength {
-		sz = DNS952MaxLength
+	if sz > max {
+		sz = max
 	}
 	last := sz - 1
 	label := make([]byte, sz, sz)
@@ -38,6 +38,7 @@ func TestAsDNS952(t *testing.T) {
 		"89fdgsf---gs7-fgs--d7fddg-123":   "fdgsf---gs7-fgs--d7fddg1",
 		"89fdgsf---gs7-fgs--d7fddg---123": "fdgsf---gs7-fgs--d7fddg1",
 		"89fdgsf---gs7-fgs--d7fddg-":      "fdgsf---gs7-fgs--d7fddg",
+		"Zz9":                             "zz9",
 	}
 	for untrusted, expected := range tests {
 		actual := AsDNS952(untrusted)
@@ -46,3 +47,19 @@ func TestAsDNS952(t *testing.T) {
 		}
 	}
 }
+
+func TestAsLabel(t *testing.T) {
+	tests := map[string]string{
+		"":                              "",
+		"a.b.c.d.e":                     "a-b-c-d-e",
+		"4abc123":                       "abc123",
+		"89fdgsf---gs7-fgs--d7fddg-123": "fdgsf---gs7-fgs--d7fddg-123",
+		"a-very-long-application-name-that-goes-well-over-the-dns-length-limit": "a-very-long-application-name-that-goes-well-over-the-dns-length",
+	}
+	for untrusted, expected := range tests {
+		actual := AsLabel(untrusted)
+		if actual != expected {
+			t.Fatalf("expected %q instead of %q after converting %q", expected, actual, untrusted)
+		}
+	}
+}
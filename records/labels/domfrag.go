@@ -4,6 +4,12 @@ package labels
 // a valid domain fragment will consist of one or more dns952 labels
 // concatenated by a '.' char.
 func AsDomainFrag(name string) string {
+	return DomainFrag(name, AsDNS952)
+}
+
+// mangles the given name in order to produce a valid domain fragment,
+// using the label func to mangle every label of the fragment.
+func DomainFrag(name string, label func(string) string) string {
 	if name == "" {
 		return ""
 	}
@@ -13,7 +19,7 @@ func AsDomainFrag(name string) string {
 	li := -1 // last fragment we found ended here
 	for i, c := range name {
 		if c == '.' {
-			if f := AsDNS952(name[li+1 : i]); f != "" {
+			if f := label(name[li+1 : i]); f != "" {
 				if li > -1 {
 					frag[ll] = '.'
 					ll++
@@ -26,7 +32,7 @@ func AsDomainFrag(name string) string {
 		}
 	}
 	// final frag
-	if f := AsDNS952(name[li+1:]); f != "" {
+	if f := label(name[li+1:]); f != "" {
 		if li > -1 {
 			frag[ll] = '.'
 			ll++
@@ -39,3 +39,17 @@ func TestAsDomainFrag(t *testing.T) {
 		}
 	}
 }
+
+func TestDomainFrag(t *testing.T) {
+	cases := map[string]string{
+		"api.payments.prod":                            "api.payments.prod",
+		"a-long-application-name.payments-and-billing": "a-long-application-name.payments-and-billing",
+		"4api..Payments.":                              "api.payments",
+	}
+	for orig, exp := range cases {
+		act := DomainFrag(orig, AsLabel)
+		if act != exp {
+			t.Fatalf("expected %q instead of %q for case %q", exp, act, orig)
+		}
+	}
+}
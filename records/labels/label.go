@@ -0,0 +1,30 @@
+package labels
+
+// LabelMaxLength is the maximum length of a domain name label (RFC 1035)
+const LabelMaxLength int = 63
+
+// IsLabel returns true if the given label is a valid domain name label,
+// i.e. it matches the regexp:
+//
+//	^[a-z]([-a-z0-9]*[a-z0-9])?$
+//
+// and is no longer than LabelMaxLength.
+func IsLabel(label string) bool {
+	sz := len(label)
+	if sz == 0 || sz > LabelMaxLength {
+		return false
+	}
+	for i := 0; i < sz; i++ {
+		c := label[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9', c == '-':
+			if i == 0 || (c == '-' && i == sz-1) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
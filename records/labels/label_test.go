@@ -0,0 +1,28 @@
+package labels
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsLabel(t *testing.T) {
+	tests := map[string]bool{
+		"":                      false,
+		"a":                     true,
+		"abc-123":               true,
+		"abc--123":              true,
+		"4abc":                  false,
+		"-abc":                  false,
+		"abc-":                  false,
+		"ABC":                   false,
+		"a.b":                   false,
+		"a_b":                   false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	}
+	for label, expected := range tests {
+		if actual := IsLabel(label); actual != expected {
+			t.Fatalf("expected %v instead of %v for label %q", expected, actual, label)
+		}
+	}
+}
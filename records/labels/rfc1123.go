@@ -0,0 +1,72 @@
+package labels
+
+// NameMaxLength is the maximum length of a domain name (RFC 1123), not
+// counting the trailing dot
+const NameMaxLength int = 253
+
+// mangle the given name to be compliant as a RFC1123 label. unlike
+// AsDNS952, labels may start with a digit and be up to LabelMaxLength long.
+// the returned result should match the regexp:
+//
+//	^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+//
+// returns "" if the name cannot be mangled.
+func AsRFC1123(name string) string {
+	if name == "" {
+		return ""
+	}
+	sz := len(name)
+	if sz > LabelMaxLength {
+		sz = LabelMaxLength
+	}
+	label := make([]byte, 0, sz)
+	la := -1 // index of last alphanumeric
+	for _, c := range name {
+		b := dns952table[uint8(c)]
+		switch {
+		case b == -int32('-'):
+			if len(label) == 0 {
+				continue
+			}
+			b = -b
+		case b < 0:
+			b = -b
+			la = len(label)
+		case b > 0:
+			la = len(label)
+		default:
+			continue
+		}
+		label = append(label, byte(b))
+		if len(label) == sz {
+			break
+		}
+	}
+	return string(label[:la+1])
+}
+
+// IsRFC1123 returns true if the given label is a valid RFC1123 label, i.e.
+// it matches the regexp:
+//
+//	^[a-z0-9]([-a-z0-9]*[a-z0-9])?$
+//
+// and is no longer than LabelMaxLength.
+func IsRFC1123(label string) bool {
+	sz := len(label)
+	if sz == 0 || sz > LabelMaxLength {
+		return false
+	}
+	for i := 0; i < sz; i++ {
+		c := label[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case c == '-':
+			if i == 0 || i == sz-1 {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,46 @@
+package labels
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAsRFC1123(t *testing.T) {
+	tests := map[string]string{
+		"":                             "",
+		"-":                            "",
+		"a---":                         "a",
+		"---a---b":                     "a---b",
+		"a.b.c.d.e":                    "a-b-c-d-e",
+		"3scale-gateway":               "3scale-gateway",
+		"20140803-125133-0-S1":         "20140803-125133-0-s1",
+		"fd%gsf---gs7-f$gs--z9":        "fdgsf---gs7-fgs--z9",
+		strings.Repeat("a", 70):        strings.Repeat("a", 63),
+		strings.Repeat("a", 62) + "-b": strings.Repeat("a", 62),
+	}
+	for untrusted, expected := range tests {
+		actual := AsRFC1123(untrusted)
+		if actual != expected {
+			t.Fatalf("expected %q instead of %q after converting %q", expected, actual, untrusted)
+		}
+	}
+}
+
+func TestIsRFC1123(t *testing.T) {
+	tests := map[string]bool{
+		"":                      false,
+		"a":                     true,
+		"3scale-gateway":        true,
+		"-abc":                  false,
+		"abc-":                  false,
+		"ABC":                   false,
+		"a.b":                   false,
+		strings.Repeat("a", 63): true,
+		strings.Repeat("a", 64): false,
+	}
+	for label, expected := range tests {
+		if actual := IsRFC1123(label); actual != expected {
+			t.Fatalf("expected %v instead of %v for label %q", expected, actual, label)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package records
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records/labels"
+)
+
+// Default record name templates, these generate the names Mesos-DNS has
+// always generated for tasks
+const (
+	DefaultTaskName     = "{name}.{framework}"
+	DefaultTaskHostName = "{name}-{hash}-{slave}.{framework}"
+)
+
+// Template is a parsed record name template. Templates are made of
+// literal text and the following placeholders:
+//
+//	{name}       the task name, split into multiple labels at its dots
+//	             if Config.MultiLabelNames is set. the rest of the label
+//	             of {name} goes to the first label of the task name, e.g.
+//	             "{name}-{hash}" gives "api-12345.payments.prod"
+//	{framework}  the framework name
+//	{slave}      the last field of the slave id
+//	{hash}       a hash of the task id
+//	{role}       the framework role
+//	{label:KEY}  the value of the task label KEY
+type Template struct {
+	src   string
+	parts []templatePart
+}
+
+// templatePart is either a literal or a placeholder with an optional
+// argument
+type templatePart struct {
+	literal string
+	key     string
+	arg     string
+}
+
+// ParseTemplate parses a record name template, it fails on unknown
+// placeholders and on literals that can't be part of a domain name
+func ParseTemplate(src string) (Template, error) {
+	t := Template{src: src}
+	if src == "" {
+		return t, errors.New("empty template")
+	}
+
+	rest := src
+	for rest != "" {
+		i := strings.IndexAny(rest, "{}")
+		if i == -1 {
+			i = len(rest)
+		}
+		if i > 0 {
+			lit := strings.ToLower(rest[:i])
+			if strings.Trim(lit, "abcdefghijklmnopqrstuvwxyz0123456789-.") != "" {
+				return t, fmt.Errorf("invalid characters in template %q", src)
+			}
+			t.parts = append(t.parts, templatePart{literal: lit})
+			rest = rest[i:]
+			continue
+		}
+		if rest[0] == '}' {
+			return t, fmt.Errorf("unbalanced braces in template %q", src)
+		}
+
+		j := strings.Index(rest, "}")
+		if j == -1 {
+			return t, fmt.Errorf("unbalanced braces in template %q", src)
+		}
+		p := templatePart{key: rest[1:j]}
+		if k := strings.Index(p.key, ":"); k != -1 {
+			p.key, p.arg = p.key[:k], p.key[k+1:]
+		}
+		switch p.key {
+		case "name", "framework", "slave", "hash", "role":
+			if p.arg != "" {
+				return t, fmt.Errorf("unexpected argument for {%s} in template %q", p.key, src)
+			}
+		case "label":
+			if p.arg == "" {
+				return t, fmt.Errorf("missing label key in template %q", src)
+			}
+		default:
+			return t, fmt.Errorf("unknown placeholder {%s} in template %q", p.key, src)
+		}
+		t.parts = append(t.parts, p)
+		rest = rest[j+1:]
+	}
+	return t, nil
+}
+
+// String returns the source of the template
+func (t Template) String() string {
+	return t.src
+}
+
+// Label specs, the rules used to mangle names into labels
+const (
+	LabelSpecRFC952  = "rfc952"
+	LabelSpecRFC1123 = "rfc1123"
+)
+
+// labelSpec holds the functions that mangle and validate labels
+type labelSpec struct {
+	label     func(string) string // mangles single label names
+	longLabel func(string) string // mangles the labels of multi-label names
+	valid     func(string) bool
+}
+
+var labelSpecs = map[string]*labelSpec{
+	LabelSpecRFC952:  {labels.AsDNS952, labels.AsLabel, labels.IsLabel},
+	LabelSpecRFC1123: {labels.AsRFC1123, labels.AsRFC1123, labels.IsRFC1123},
+}
+
+// getLabelSpec returns the label spec of the config, RFC952 by default
+func getLabelSpec(c Config) (*labelSpec, error) {
+	if c.LabelSpec == "" {
+		return labelSpecs[LabelSpecRFC952], nil
+	}
+	spec, ok := labelSpecs[strings.ToLower(c.LabelSpec)]
+	if !ok {
+		return nil, fmt.Errorf("unknown label spec %q", c.LabelSpec)
+	}
+	return spec, nil
+}
+
+// taskNaming holds the values for the placeholders of a single task
+type taskNaming struct {
+	name      string
+	framework string
+	slave     string
+	hash      string
+	role      string
+	labels    map[string]string
+
+	spec *labelSpec
+
+	// multiLabel turns the dots of the task name into label separators
+	multiLabel bool
+}
+
+// value returns the mangled value of a placeholder
+func (n *taskNaming) value(key, arg string) string {
+	switch key {
+	case "name":
+		if n.multiLabel {
+			return labels.DomainFrag(n.name, n.spec.longLabel)
+		}
+		return n.spec.label(n.name)
+	case "framework":
+		return labels.DomainFrag(n.framework, n.spec.label)
+	case "slave":
+		return n.slave
+	case "hash":
+		return n.hash
+	case "role":
+		return n.spec.label(n.role)
+	case "label":
+		return n.spec.label(n.labels[arg])
+	}
+	return ""
+}
+
+// rawValue returns the value of a placeholder before mangling
+func (n *taskNaming) rawValue(key, arg string) string {
+	switch key {
+	case "name":
+		return n.name
+	case "framework":
+		return n.framework
+	case "slave":
+		return n.slave
+	case "hash":
+		return n.hash
+	case "role":
+		return n.role
+	case "label":
+		return n.labels[arg]
+	}
+	return ""
+}
+
+// expand returns the name generated by the template for a task, relative
+// to the Mesos domain. It fails if the name is made of invalid labels,
+// e.g. because one of the placeholders is empty for the task.
+func (t Template) expand(n *taskNaming) (string, error) {
+	name := t.fill(n.value, n.multiLabel)
+	for _, label := range strings.Split(name, ".") {
+		if !n.spec.valid(label) {
+			return "", fmt.Errorf("invalid label %q in name %q from template %q", label, name, t.src)
+		}
+	}
+	return name, nil
+}
+
+// origin returns the name the template would generate for a task without
+// mangling, which tells apart tasks whose names collide after mangling
+func (t Template) origin(n *taskNaming) string {
+	return strings.ToLower(t.fill(n.rawValue, n.multiLabel))
+}
+
+// fill returns the template with the values of the placeholders. with
+// multiLabel, the labels of the task name after the first one are moved
+// after the rest of the label of {name}, so that "{name}-{hash}" gives
+// "api-12345.payments.prod" rather than "api.payments.prod-12345".
+func (t Template) fill(value func(key, arg string) string, multiLabel bool) string {
+	parts := make([]string, 0, len(t.parts)+1)
+	var moved string // the labels of the task name after the first one
+	for _, p := range t.parts {
+		s := p.literal
+		if p.key != "" {
+			s = value(p.key, p.arg)
+		}
+		i := strings.Index(s, ".")
+		switch {
+		case moved != "" && i != -1:
+			// the label of {name} ends here
+			parts = append(parts, s[:i], moved, s[i:])
+			moved = ""
+		case moved == "" && multiLabel && p.key == "name" && i != -1:
+			parts = append(parts, s[:i])
+			moved = s[i:]
+		default:
+			parts = append(parts, s)
+		}
+	}
+	parts = append(parts, moved)
+	return strings.Join(parts, "")
+}
+
+// fqdn returns the fully qualified name of name in domain, failing if it
+// is too long to be a domain name
+func fqdn(name, domain string) (string, error) {
+	full := name + "." + domain
+	if len(full) > labels.NameMaxLength {
+		return "", fmt.Errorf("name %q is longer than %d characters", full, labels.NameMaxLength)
+	}
+	return full + ".", nil
+}
+
+// nameOrigins maps every generated name to the unmangled name it was
+// generated from
+type nameOrigins map[string]string
+
+// claim records origin as the origin of name. It reports a collision and
+// returns false if name was already generated from a different origin.
+func (o nameOrigins) claim(name, origin string) bool {
+	if prev, ok := o[name]; ok && prev != origin {
+		logging.Error.Printf("name collision: %s is generated from both %q and %q, skipping the latter", name, prev, origin)
+		return false
+	}
+	o[name] = origin
+	return true
+}
+
+// taskTemplates returns the parsed task name templates of the config,
+// falling back to the defaults when they are not set
+func taskTemplates(c Config) ([]Template, Template, error) {
+	names := c.TaskNames
+	if len(names) == 0 {
+		names = []string{DefaultTaskName}
+	}
+	hostName := c.TaskHostName
+	if hostName == "" {
+		hostName = DefaultTaskHostName
+	}
+
+	tnames := make([]Template, 0, len(names))
+	for _, name := range names {
+		t, err := ParseTemplate(name)
+		if err != nil {
+			return nil, Template{}, err
+		}
+		tnames = append(tnames, t)
+	}
+
+	thost, err := ParseTemplate(hostName)
+	if err != nil {
+		return nil, Template{}, err
+	}
+	return tnames, thost, nil
+}
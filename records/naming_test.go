@@ -0,0 +1,205 @@
+package records
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseTemplate(t *testing.T) {
+	valid := []string{
+		DefaultTaskName,
+		DefaultTaskHostName,
+		"{label:GROUP}.{name}.{framework}",
+		"{name}.{role}.{framework}",
+		"web-{name}.Prod",
+	}
+	for _, src := range valid {
+		if _, err := ParseTemplate(src); err != nil {
+			t.Errorf("unexpected error for template %q: %v", src, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"{name",
+		"name}",
+		"{unknown}.{framework}",
+		"{label}.{framework}",
+		"{name:arg}.{framework}",
+		"{name}_{framework}",
+	}
+	for _, src := range invalid {
+		if _, err := ParseTemplate(src); err == nil {
+			t.Errorf("expected an error for template %q", src)
+		}
+	}
+}
+
+func TestTemplateExpand(t *testing.T) {
+	n := &taskNaming{
+		name:      "liquor.store",
+		framework: "marathon",
+		slave:     "s1",
+		hash:      "12345",
+		role:      "prod",
+		labels:    map[string]string{"GROUP": "Payments"},
+		spec:      labelSpecs[LabelSpecRFC952],
+	}
+
+	tests := map[string]string{
+		DefaultTaskName:                    "liquor-store.marathon",
+		DefaultTaskHostName:                "liquor-store-12345-s1.marathon",
+		"{label:GROUP}.{name}.{framework}": "payments.liquor-store.marathon",
+		"{name}.{role}.{framework}":        "liquor-store.prod.marathon",
+		"web-{name}.Prod":                  "web-liquor-store.prod",
+		"{label:MISSING}.{framework}":      "",
+		"{hash}.{framework}":               "",
+	}
+	for src, expected := range tests {
+		tmpl, err := ParseTemplate(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := tmpl.expand(n)
+		if expected == "" && err == nil {
+			t.Errorf("expected an error for template %q instead of %q", src, actual)
+		} else if expected != "" && actual != expected {
+			t.Errorf("expected %q instead of %q for template %q (%v)", expected, actual, src, err)
+		}
+	}
+}
+
+func TestTemplateExpandMultiLabel(t *testing.T) {
+	n := &taskNaming{
+		name:       "api.payments-and-billing-service.prod",
+		framework:  "marathon",
+		slave:      "s1",
+		hash:       "12345",
+		spec:       labelSpecs[LabelSpecRFC952],
+		multiLabel: true,
+	}
+
+	tests := map[string]string{
+		DefaultTaskName:     "api.payments-and-billing-service.prod.marathon",
+		DefaultTaskHostName: "api-12345-s1.payments-and-billing-service.prod.marathon",
+		"web-{name}":        "web-api.payments-and-billing-service.prod",
+		"{name}-{hash}":     "api-12345.payments-and-billing-service.prod",
+	}
+	for src, expected := range tests {
+		tmpl, err := ParseTemplate(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual, err := tmpl.expand(n); actual != expected {
+			t.Errorf("expected %q instead of %q for template %q (%v)", expected, actual, src, err)
+		}
+	}
+}
+
+func TestInsertStateTemplates(t *testing.T) {
+	sj := StateJSON{
+		Leader: "master@144.76.157.37:5050",
+		Slaves: Slaves{{Id: "20140803-125133-3041283216-5050-2410-0", Hostname: "1.2.3.11"}},
+	}
+	sj.Frameworks = make(Frameworks, 1)
+	sj.Frameworks[0].Name = "marathon"
+	sj.Frameworks[0].Role = "prod"
+	sj.Frameworks[0].Tasks = make(Tasks, 1)
+	sj.Frameworks[0].Tasks[0].Id = "api.1"
+	sj.Frameworks[0].Tasks[0].Name = "api"
+	sj.Frameworks[0].Tasks[0].SlaveId = "20140803-125133-3041283216-5050-2410-0"
+	sj.Frameworks[0].Tasks[0].State = "TASK_RUNNING"
+	sj.Frameworks[0].Tasks[0].Resources.Ports = "[31000-31000]"
+
+	c := fakeConfig()
+	c.TaskNames = []string{"{name}.{role}.{framework}"}
+	c.TaskHostName = "{name}-{slave}.{framework}"
+
+	rg := RecordGenerator{}
+	if err := rg.InsertState(sj, c); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rg.Lookup("api.prod.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should find the templated name - A record")
+	}
+	if len(rg.Lookup("api-0.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should find the templated host name - A record")
+	}
+	if len(rg.Lookup("api.marathon.mesos.", dns.TypeA)) != 0 {
+		t.Error("should not find the default name - A record")
+	}
+
+	rrs := rg.Lookup("_api._tcp.prod.marathon.mesos.", dns.TypeSRV)
+	if len(rrs) != 1 || rrs[0].RR.(*dns.SRV).Target != "api-0.marathon.mesos." || rrs[0].RR.(*dns.SRV).Port != 31000 {
+		t.Error("should find the templated name - SRV record")
+	}
+}
+
+func TestTemplateExpandRFC1123(t *testing.T) {
+	n := &taskNaming{
+		name:      "3scale-gateway",
+		framework: "marathon-0.7.5",
+		spec:      labelSpecs[LabelSpecRFC1123],
+	}
+
+	tmpl, err := ParseTemplate(DefaultTaskName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "3scale-gateway.marathon-0.7.5"
+	if actual, err := tmpl.expand(n); actual != expected {
+		t.Errorf("expected %q instead of %q (%v)", expected, actual, err)
+	}
+}
+
+// fakeTasksState returns a state with a running task for each name, the
+// tasks are spread over two slaves
+func fakeTasksState(names ...string) StateJSON {
+	sj := StateJSON{
+		Leader: "master@144.76.157.37:5050",
+		Slaves: Slaves{
+			{Id: "20140803-125133-3041283216-5050-2410-0", Hostname: "1.2.3.11"},
+			{Id: "20140803-125133-3041283216-5050-2410-1", Hostname: "1.2.3.12"},
+		},
+	}
+	sj.Frameworks = make(Frameworks, 1)
+	sj.Frameworks[0].Name = "marathon"
+	sj.Frameworks[0].Tasks = make(Tasks, len(names))
+	for i, name := range names {
+		sj.Frameworks[0].Tasks[i].Id = name + "." + strconv.Itoa(i)
+		sj.Frameworks[0].Tasks[i].Name = name
+		sj.Frameworks[0].Tasks[i].SlaveId = sj.Slaves[i%2].Id
+		sj.Frameworks[0].Tasks[i].State = "TASK_RUNNING"
+	}
+	return sj
+}
+
+func TestInsertStateCollisions(t *testing.T) {
+	sj := fakeTasksState("scale-gateway", "3scale-gateway")
+
+	rg := RecordGenerator{}
+	if err := rg.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+	// 3scale-gateway runs on the second slave
+	rrs := rg.Lookup("scale-gateway.marathon.mesos.", dns.TypeA)
+	if len(rrs) != 1 || rrs[0].RR.(*dns.A).A.String() != "1.2.3.11" {
+		t.Error("should not merge tasks whose names collide after mangling")
+	}
+
+	c := fakeConfig()
+	c.LabelSpec = LabelSpecRFC1123
+	rg = RecordGenerator{}
+	if err := rg.InsertState(sj, c); err != nil {
+		t.Fatal(err)
+	}
+	if len(rg.Lookup("3scale-gateway.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should find the task starting with a digit - A record")
+	}
+	if len(rg.Lookup("scale-gateway.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should find the task - A record")
+	}
+}
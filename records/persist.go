@@ -0,0 +1,64 @@
+package records
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// SavedRecords is a record set in a format to save it, e.g. to disk, and
+// load it back
+type SavedRecords struct {
+	Domain  string
+	Records []SavedRecord
+	Slaves  map[string]string `json:",omitempty"`
+}
+
+// SavedRecord is a record in master file format along with its owner
+type SavedRecord struct {
+	RR    string
+	Owner *Owner `json:",omitempty"`
+}
+
+// Save returns the records of rg, generated for domain, in a format to
+// save them. The records are sorted so that equal record sets are saved
+// alike.
+func (rg *RecordGenerator) Save(domain string) SavedRecords {
+	saved := SavedRecords{Domain: domain, Slaves: rg.Slaves}
+	for _, set := range rg.Records {
+		for _, recs := range set {
+			for _, rec := range recs {
+				saved.Records = append(saved.Records, SavedRecord{RR: rec.RR.String(), Owner: rec.Owner})
+			}
+		}
+	}
+	sort.Slice(saved.Records, func(i, j int) bool {
+		return saved.Records[i].RR < saved.Records[j].RR
+	})
+	return saved
+}
+
+// Load returns the record set of the saved records, with the same hash as
+// the one they were saved from
+func (saved SavedRecords) Load() (*RecordGenerator, error) {
+	if saved.Domain == "" {
+		return nil, errors.New("saved records without a domain")
+	}
+
+	rg := &RecordGenerator{Slaves: saved.Slaves}
+	rg.Records = make(map[string]RRSet)
+	rg.keys = make(map[string]struct{})
+	for _, rec := range saved.Records {
+		rr, err := dns.NewRR(rec.RR)
+		if err != nil {
+			return nil, err
+		}
+		if rr == nil {
+			return nil, errors.New("empty saved record")
+		}
+		rg.insertRR(rr, rec.Owner)
+	}
+	rg.finish(saved.Domain)
+	return rg, nil
+}
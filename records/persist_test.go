@@ -0,0 +1,50 @@
+package records
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSaveLoad(t *testing.T) {
+	sj := fakeTasksState("liquor-store", "chronos")
+	sj.Frameworks[0].Tasks[0].Labels = []Label{{Key: AliasLabel, Value: "shop"}}
+
+	var rg RecordGenerator
+	if err := rg.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(rg.Save("mesos"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved SavedRecords
+	if err = json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := saved.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.Hash() != rg.Hash() {
+		t.Errorf("expected the hash %q of the saved records instead of %q", rg.Hash(), loaded.Hash())
+	}
+	as := loaded.Lookup("liquor-store.marathon.mesos.", dns.TypeA)
+	if len(as) != 1 || as[0].Owner == nil || as[0].Owner.TaskName != "liquor-store" {
+		t.Errorf("expected the A record along with its owner instead of %v", as)
+	}
+	if !loaded.Exists("marathon.mesos.") || len(loaded.Lookup("shop.mesos.", dns.TypeCNAME)) != 1 {
+		t.Error("should index the names of the loaded records")
+	}
+	if len(loaded.Slaves) != len(rg.Slaves) {
+		t.Error("should load the slaves")
+	}
+
+	saved.Records = append(saved.Records, SavedRecord{RR: "invalid IN A record"})
+	if _, err = saved.Load(); err == nil {
+		t.Error("expected an error for an invalid record")
+	}
+}
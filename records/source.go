@@ -0,0 +1,131 @@
+package records
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/miekg/dns"
+)
+
+// StateSource is a source of the records served by mesos-dns
+type StateSource interface {
+	// Records generates the records of the current state. leader is the
+	// leading master detected by Zookeeper (ip:port), if any.
+	Records(leader string, c Config) (*RecordGenerator, error)
+}
+
+// NewStateSource returns the state source of a config: a state.json file
+// if StateFile is set, a directory of zone files if ZoneDir is set, or
+// else the mesos masters
+func NewStateSource(c Config) StateSource {
+	switch {
+	case c.StateFile != "":
+		return FileSource{Path: c.StateFile}
+	case c.ZoneDir != "":
+		return ZoneDirSource{Dir: c.ZoneDir}
+	default:
+		return MasterSource{}
+	}
+}
+
+// MasterSource loads the state from state.json of the leading mesos master,
+// the one detected by Zookeeper or else the leader among the masters of the
+// config
+type MasterSource struct{}
+
+func (MasterSource) Records(leader string, c Config) (*RecordGenerator, error) {
+	rg := &RecordGenerator{}
+	if err := rg.ParseState(leader, c); err != nil {
+		return nil, err
+	}
+	return rg, nil
+}
+
+// FileSource loads the state from a state.json file, e.g. a snapshot
+// exported from a master with
+//
+//	curl http://master:5050/master/state.json
+type FileSource struct {
+	Path string
+}
+
+func (s FileSource) Records(_ string, c Config) (*RecordGenerator, error) {
+	b, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sj StateJSON
+	if err := json.Unmarshal(b, &sj); err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	if sj.Leader == "" {
+		return nil, errors.New(s.Path + ": no leader in state")
+	}
+
+	rg := &RecordGenerator{}
+	if err := rg.InsertState(sj, c); err != nil {
+		return nil, err
+	}
+	return rg, nil
+}
+
+// ZoneDirSource loads the records from the zone files (RFC 1035) in a
+// directory, the files with the .zone extension in alphabetical order.
+// Relative names are within the domain of the config, records outside of
+// it are skipped. The records are validated like static records, see
+// validateStatic, and are served whatever their type.
+type ZoneDirSource struct {
+	Dir string
+}
+
+func (s ZoneDirSource) Records(_ string, c Config) (*RecordGenerator, error) {
+	files, err := filepath.Glob(filepath.Join(s.Dir, "*.zone"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(s.Dir); err != nil {
+			return nil, err
+		}
+	}
+
+	apex := c.Domain + "."
+	var all []dns.RR
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		rrs, err := parseZone(string(b), apex, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range rrs {
+			name := rr.Header().Name
+			if name != apex && !strings.HasSuffix(name, "."+apex) {
+				logging.Verbose.Println("Warning: skipping record outside of the domain in " + file + ": " + rr.String())
+				continue
+			}
+			all = append(all, rr)
+		}
+	}
+	if err := validateStatic(all, apex); err != nil {
+		return nil, err
+	}
+
+	rg := &RecordGenerator{}
+	rg.init(c)
+	for _, rr := range all {
+		rg.insertRR(rr, nil)
+	}
+	rg.listenerRecord(c.Listener, c.SOARname)
+	rg.finish(c.Domain)
+	return rg, nil
+}
@@ -0,0 +1,129 @@
+package records
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewStateSource(t *testing.T) {
+	c := fakeConfig()
+	if _, ok := NewStateSource(c).(MasterSource); !ok {
+		t.Error("should load from the masters by default")
+	}
+	c.StateFile = "state.json"
+	if s, ok := NewStateSource(c).(FileSource); !ok || s.Path != "state.json" {
+		t.Error("should load from the state file")
+	}
+	c.StateFile, c.ZoneDir = "", "zones"
+	if s, ok := NewStateSource(c).(ZoneDirSource); !ok || s.Dir != "zones" {
+		t.Error("should load from the zone directory")
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	rg, err := FileSource{Path: "../factories/fake.json"}.Records("", fakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should find this running task - A record")
+	}
+	if countNames(rg, dns.TypeA) != 19 {
+		t.Error("should generate the same records as the master state")
+	}
+
+	dir, err := ioutil.TempDir("", "mesos-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := map[string]string{
+		"noleader.json": `{"frameworks": []}`,
+		"invalid.json":  `{"frameworks": `,
+	}
+	for name, state := range invalid {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(state), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (FileSource{Path: path}).Records("", fakeConfig()); err == nil {
+			t.Errorf("expected an error for %s", name)
+		}
+	}
+	if _, err := (FileSource{Path: filepath.Join(dir, "missing.json")}).Records("", fakeConfig()); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestZoneDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"db.zone": `$TTL 30
+db          IN A    10.0.0.1
+db          IN A    10.0.0.2
+_db._tcp    IN SRV  0 0 5432 db
+Web.Legacy  IN TXT  "owner=web"
+mail        IN MX   10 db
+`,
+		"outside.zone": `www.example.com. IN A 10.0.0.3
+`,
+		"README": `not a zone file`,
+	}
+	for name, zone := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(zone), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rg, err := ZoneDirSource{Dir: dir}.Records("", fakeConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := rg.Lookup("db.mesos.", dns.TypeA)
+	if len(as) != 2 || as[0].RR.Header().Ttl != 30 {
+		t.Errorf("should find the A records of the zone, found %v", as)
+	}
+	srvs := rg.Lookup("_db._tcp.mesos.", dns.TypeSRV)
+	if len(srvs) != 1 || srvs[0].RR.(*dns.SRV).Target != "db.mesos." {
+		t.Errorf("should find the SRV records of the zone, found %v", srvs)
+	}
+	if len(rg.Lookup("web.legacy.mesos.", dns.TypeTXT)) != 1 || !rg.Exists("legacy.mesos.") {
+		t.Error("should find the lowercased TXT record of the zone and its parent")
+	}
+	if len(rg.Lookup("mail.mesos.", dns.TypeMX)) != 1 {
+		t.Error("should find the MX record of the zone")
+	}
+	if rg.Exists("www.example.com.") {
+		t.Error("should skip the records outside of the domain")
+	}
+	if len(rg.Lookup("mesos-dns.mesos.", dns.TypeA)) != 1 {
+		t.Error("should find mesos-dns - A record")
+	}
+
+	for _, zone := range []string{
+		"db IN A not-an-ip\n",
+		"@ IN SOA ns1.mesos. root.mesos. 1 60 600 86400 60\n",
+		"@ IN NS ns2.mesos.\n",
+		"db IN CNAME web\n",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "broken.zone"), []byte(zone), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := (ZoneDirSource{Dir: dir}).Records("", fakeConfig()); err == nil {
+			t.Errorf("expected an error for the zone file %q", zone)
+		}
+	}
+	if _, err := (ZoneDirSource{Dir: filepath.Join(dir, "missing")}).Records("", fakeConfig()); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
@@ -0,0 +1,181 @@
+package records
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/miekg/dns"
+)
+
+// Rules for static records whose name and type also have generated records
+const (
+	// the static records replace the generated ones
+	StaticOverride = "override"
+	// the static records are added to the generated ones
+	StaticMerge = "merge"
+	// the static records are skipped
+	StaticSkip = "skip"
+)
+
+// staticRecords returns the static records of the config, from
+// StaticRecords and StaticZoneFile. Relative names are within the domain,
+// and the TTL defaults to the TTL of the config. SetConfig parses them
+// once, InsertState parses them again only for configs it didn't load.
+func staticRecords(c Config) ([]dns.RR, error) {
+	var rrs []dns.RR
+	apex := c.Domain + "."
+	ttl := "$TTL " + strconv.Itoa(int(c.TTL)) + "\n"
+
+	if len(c.StaticRecords) > 0 {
+		zone := ttl + strings.Join(c.StaticRecords, "\n") + "\n"
+		parsed, err := parseZone(zone, apex, "StaticRecords")
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, parsed...)
+	}
+
+	if c.StaticZoneFile != "" {
+		b, err := ioutil.ReadFile(c.StaticZoneFile)
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := parseZone(ttl+string(b), apex, c.StaticZoneFile)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, parsed...)
+	}
+
+	if err := validateStatic(rrs, apex); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
+
+// parseZone returns the records of a zone in master file format
+func parseZone(zone string, origin string, file string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	var err error
+	// read all the tokens, the parser blocks otherwise
+	for t := range dns.ParseZone(strings.NewReader(zone), origin, file) {
+		if t.Error != nil {
+			if err == nil {
+				err = t.Error
+			}
+			continue
+		}
+		t.RR.Header().Name = strings.ToLower(t.RR.Header().Name)
+		rrs = append(rrs, t.RR)
+	}
+	return rrs, err
+}
+
+// validateStatic checks that the static records, or the records of a zone
+// directory, are within the domain,
+// leave the SOA and NS records of the domain to mesos-dns, and that names
+// with a CNAME record have no other records
+func validateStatic(rrs []dns.RR, apex string) error {
+	types := make(map[string]map[uint16]int)
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		if hdr.Name != apex && !strings.HasSuffix(hdr.Name, "."+apex) {
+			return errors.New("static record outside of the domain: " + rr.String())
+		}
+		if hdr.Rrtype == dns.TypeSOA || (hdr.Rrtype == dns.TypeNS && hdr.Name == apex) {
+			return errors.New("static record replacing the " + dns.TypeToString[hdr.Rrtype] + " record of the domain: " + rr.String())
+		}
+		if types[hdr.Name] == nil {
+			types[hdr.Name] = make(map[uint16]int)
+		}
+		types[hdr.Name][hdr.Rrtype]++
+	}
+	for name, counts := range types {
+		if n := counts[dns.TypeCNAME]; n > 0 && (n > 1 || len(counts) > 1) {
+			return errors.New("static CNAME record of " + name + " along with other records")
+		}
+	}
+	return nil
+}
+
+// insertStatic merges the static records into the generated ones, rule
+// decides which records win when both have the same name and type. A CNAME
+// record conflicts with any generated record of its name and replaces them
+// all unless the rule is StaticSkip. Likewise, a generated CNAME record,
+// e.g. of an alias, conflicts with static records of any type and is
+// dropped unless the rule is StaticSkip, which drops those instead. The
+// static records are parsed once and shared by every reload, so copies of
+// them are inserted.
+func (rg *RecordGenerator) insertStatic(rrs []dns.RR, rule string) {
+	if rule == "" {
+		rule = StaticOverride
+	}
+
+	// find the conflicts before inserting any static record
+	conflicts := make(map[string]bool)
+	cnames := make(map[string]bool) // names with a generated CNAME record
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		set := rg.Records[hdr.Name]
+		if (hdr.Rrtype == dns.TypeCNAME && len(set) > 0) || len(set[hdr.Rrtype]) > 0 {
+			conflicts[hdr.Name+" "+dns.TypeToString[hdr.Rrtype]] = true
+		} else if len(set[dns.TypeCNAME]) > 0 {
+			cnames[hdr.Name] = true
+		}
+	}
+
+	// static records are only deduplicated among themselves
+	rg.keys = make(map[string]struct{})
+	for _, rr := range rrs {
+		hdr := rr.Header()
+		conflict := hdr.Name + " " + dns.TypeToString[hdr.Rrtype]
+		rr = dns.Copy(rr)
+		if cnames[hdr.Name] {
+			// a CNAME record can't have other records, whatever the rule
+			if rule == StaticSkip {
+				logging.VeryVerbose.Println("Warning: skipping static record conflicting with a generated CNAME record: " + rr.String())
+				continue
+			}
+			logging.Verbose.Println("static records replace the generated CNAME record of " + hdr.Name)
+			delete(rg.Records[hdr.Name], dns.TypeCNAME)
+			cnames[hdr.Name] = false
+		}
+		if !conflicts[conflict] {
+			rg.insertRR(rr, nil)
+			continue
+		}
+
+		switch {
+		case rule == StaticSkip:
+			logging.VeryVerbose.Println("Warning: skipping static record conflicting with generated records: " + rr.String())
+			continue
+		case rule == StaticOverride || hdr.Rrtype == dns.TypeCNAME:
+			// drop the generated records once
+			logging.Verbose.Println("static records replace the generated records of " + conflict)
+			if hdr.Rrtype == dns.TypeCNAME {
+				rg.Records[hdr.Name] = make(RRSet)
+			} else {
+				delete(rg.Records[hdr.Name], hdr.Rrtype)
+			}
+			conflicts[conflict] = false
+		case hasRData(rg.Records[hdr.Name][hdr.Rrtype], rr):
+			// merged, the same record was generated
+			continue
+		}
+		rg.insertRR(rr, nil)
+	}
+}
+
+// hasRData returns true if any of the records has the same data as rr
+func hasRData(recs []Record, rr dns.RR) bool {
+	rdata := strings.TrimPrefix(rr.String(), rr.Header().String())
+	for _, rec := range recs {
+		if strings.TrimPrefix(rec.RR.String(), rec.RR.Header().String()) == rdata {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package records
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStaticRecords(t *testing.T) {
+	f, err := ioutil.TempFile("", "static.zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("$TTL 300\nvault IN A 10.0.0.6\n")
+	f.Close()
+
+	c := fakeConfig()
+	c.TTL = 60
+	c.StaticRecords = []string{
+		"Registry IN A 10.0.0.5",
+		"_registry._tcp IN SRV 0 0 5000 registry",
+		"legacy-db.mesos. IN CNAME db.marathon.mesos.",
+	}
+	c.StaticZoneFile = f.Name()
+
+	rrs, err := staticRecords(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rrs) != 4 {
+		t.Fatalf("expected 4 static records instead of %d", len(rrs))
+	}
+	if hdr := rrs[0].Header(); hdr.Name != "registry.mesos." || hdr.Ttl != 60 {
+		t.Errorf("expected a relative name with the default TTL instead of %s", rrs[0])
+	}
+	if srv := rrs[1].(*dns.SRV); srv.Target != "registry.mesos." {
+		t.Errorf("expected a relative target instead of %s", srv)
+	}
+	if hdr := rrs[3].Header(); hdr.Name != "vault.mesos." || hdr.Ttl != 300 {
+		t.Errorf("expected the TTL of the zone file instead of %s", rrs[3])
+	}
+
+	invalid := [][]string{
+		{"registry IN A not-an-ip"},
+		{"www.example.com. IN A 10.0.0.1"},
+		{"@ IN NS ns2.mesos."},
+		{"@ IN SOA ns1.mesos. root.mesos. 1 60 600 86400 60"},
+		{"legacy IN CNAME db.mesos.", "legacy IN A 10.0.0.1"},
+		{"legacy IN CNAME db.mesos.", "legacy IN CNAME web.mesos."},
+	}
+	for _, records := range invalid {
+		c := fakeConfig()
+		c.StaticRecords = records
+		if _, err := staticRecords(c); err == nil {
+			t.Errorf("expected an error for static records %q", records)
+		}
+	}
+
+	c = fakeConfig()
+	c.StaticZoneFile = f.Name() + ".missing"
+	if _, err := staticRecords(c); err == nil {
+		t.Error("expected an error for a missing zone file")
+	}
+
+	// the records parsed by SetConfig aren't read again
+	c.static = rrs
+	var rg RecordGenerator
+	if err = rg.InsertState(fakeTasksState("web"), c); err != nil {
+		t.Fatal(err)
+	}
+	if len(rg.Lookup("vault.mesos.", dns.TypeA)) != 1 {
+		t.Error("expected the parsed static records")
+	}
+}
+
+func TestInsertStateStatic(t *testing.T) {
+	sj := fakeTasksState("db", "web")
+
+	tests := []struct {
+		rule string
+		ips  []string
+	}{
+		{StaticOverride, []string{"10.0.0.9", "1.2.3.11"}},
+		{StaticMerge, []string{"1.2.3.11", "10.0.0.9"}},
+		{StaticSkip, []string{"1.2.3.11"}},
+	}
+	for _, test := range tests {
+		c := fakeConfig()
+		c.StaticConflict = test.rule
+		c.StaticRecords = []string{
+			"registry IN A 10.0.0.5",
+			"db.marathon IN A 10.0.0.9",
+			"db.marathon IN A 1.2.3.11",
+			"web.marathon IN CNAME registry",
+			"api IN A 10.0.0.7",
+		}
+		c.Aliases = map[string]string{"api": "db.marathon"}
+
+		rg := RecordGenerator{}
+		if err := rg.InsertState(sj, c); err != nil {
+			t.Fatal(err)
+		}
+		if len(rg.Lookup("registry.mesos.", dns.TypeA)) != 1 {
+			t.Errorf("%s: should find the static record without conflicts", test.rule)
+		}
+
+		as := rg.Lookup("db.marathon.mesos.", dns.TypeA)
+		var ips []string
+		for _, a := range as {
+			ips = append(ips, a.RR.(*dns.A).A.String())
+		}
+		if !equalStrings(ips, test.ips) {
+			t.Errorf("%s: expected A records %q instead of %q", test.rule, test.ips, ips)
+		}
+		if len(rg.Lookup("db.marathon.mesos.", dns.TypeTXT)) != 1 {
+			t.Errorf("%s: should keep the generated records of other types", test.rule)
+		}
+
+		cnames := rg.Lookup("web.marathon.mesos.", dns.TypeCNAME)
+		generated := len(rg.Lookup("web.marathon.mesos.", dns.TypeA)) + len(rg.Lookup("web.marathon.mesos.", dns.TypeTXT))
+		if test.rule == StaticSkip {
+			if len(cnames) != 0 || generated == 0 {
+				t.Errorf("%s: should skip the CNAME record", test.rule)
+			}
+		} else if len(cnames) != 1 || generated != 0 {
+			t.Errorf("%s: should replace all the generated records with the CNAME record", test.rule)
+		}
+
+		// a generated CNAME record of an alias can't have other records
+		cnames = rg.Lookup("api.mesos.", dns.TypeCNAME)
+		as = rg.Lookup("api.mesos.", dns.TypeA)
+		if test.rule == StaticSkip {
+			if len(cnames) != 1 || len(as) != 0 {
+				t.Errorf("%s: should skip the static record of the alias", test.rule)
+			}
+		} else if len(cnames) != 0 || len(as) != 1 {
+			t.Errorf("%s: should replace the CNAME record of the alias with the static record", test.rule)
+		}
+	}
+}
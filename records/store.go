@@ -0,0 +1,220 @@
+package records
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/miekg/dns"
+)
+
+// Owner identifies the task a record was generated for
+type Owner struct {
+	TaskID      string
+	TaskName    string
+	SlaveID     string
+	FrameworkID string
+	Framework   string
+}
+
+// Record is a resource record along with the task that owns it, which is
+// nil for records that weren't generated for a task
+type Record struct {
+	RR    dns.RR
+	Owner *Owner
+}
+
+// RRSet holds the records of a name by type
+type RRSet map[uint16][]Record
+
+// Lookup returns the records of the given type of name. The records are
+// shared by all the callers and must not be modified.
+func (rg *RecordGenerator) Lookup(name string, qtype uint16) []Record {
+	return rg.Records[name][qtype]
+}
+
+// Exists returns true if name has records, or if it is the parent of a
+// name with records
+func (rg *RecordGenerator) Exists(name string) bool {
+	_, ok := rg.Records[name]
+	return ok
+}
+
+// Hash returns a hash of the names and records, record sets generated
+// from states that differ in nothing that is served have the same hash
+func (rg *RecordGenerator) Hash() string {
+	return rg.hash
+}
+
+// hashRecords computes the hash of the names and records, in a canonical
+// order since neither maps nor states are ordered
+func (rg *RecordGenerator) hashRecords() string {
+	var lines []string
+	for name, set := range rg.Records {
+		lines = append(lines, name)
+		for _, recs := range set {
+			for _, rec := range recs {
+				lines = append(lines, rec.RR.String())
+			}
+		}
+	}
+	sort.Strings(lines)
+
+	h := sha1.New()
+	for _, line := range lines {
+		h.Write([]byte(line))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// init prepares rg for the records of the domain of c
+func (rg *RecordGenerator) init(c Config) {
+	rg.Records = make(map[string]RRSet)
+	rg.ttl = uint32(c.TTL)
+	rg.keys = make(map[string]struct{})
+}
+
+// finish indexes the names and hashes the records once all are inserted
+func (rg *RecordGenerator) finish(domain string) {
+	rg.indexNames(domain)
+	rg.keys = nil
+	rg.hash = rg.hashRecords()
+}
+
+// insertRR inserts a record of any type to its name, unless it already
+// exists
+func (rg *RecordGenerator) insertRR(rr dns.RR, owner *Owner) {
+	hdr := rr.Header()
+	hdr.Name = strings.ToLower(hdr.Name)
+	rg.insert(hdr.Name, strings.TrimPrefix(rr.String(), hdr.String()), Record{RR: rr, Owner: owner})
+}
+
+// insertA inserts an A record for ip to name, unless it already exists
+func (rg *RecordGenerator) insertA(name string, ip string, owner *Owner) {
+	a := net.ParseIP(ip).To4()
+	if a == nil {
+		logging.Error.Println("invalid IPv4 address " + ip + " for " + name)
+		return
+	}
+
+	rg.insert(name, ip, Record{
+		RR: &dns.A{
+			Hdr: rg.header(name, dns.TypeA),
+			A:   a,
+		},
+		Owner: owner,
+	})
+}
+
+// insertSRV inserts a SRV record for target:port to name, unless it
+// already exists
+func (rg *RecordGenerator) insertSRV(name string, target string, port string, prio SRVPriority, owner *Owner) {
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		logging.Error.Println("invalid port " + port + " for " + name)
+		return
+	}
+
+	rg.insert(name, target+":"+port, Record{
+		RR: &dns.SRV{
+			Hdr:      rg.header(name, dns.TypeSRV),
+			Priority: prio.Priority,
+			Weight:   prio.Weight,
+			Port:     uint16(p),
+			Target:   target,
+		},
+		Owner: owner,
+	})
+}
+
+// insertTXT inserts a TXT record to name, unless it already exists
+func (rg *RecordGenerator) insertTXT(name string, txt []string, owner *Owner) {
+	rg.insert(name, fmt.Sprintf("%q", txt), Record{
+		RR: &dns.TXT{
+			Hdr: rg.header(name, dns.TypeTXT),
+			Txt: txt,
+		},
+		Owner: owner,
+	})
+}
+
+// insertCNAME inserts a CNAME record for target to name, unless it already
+// exists
+func (rg *RecordGenerator) insertCNAME(name string, target string, owner *Owner) {
+	rg.insert(name, target, Record{
+		RR: &dns.CNAME{
+			Hdr:    rg.header(name, dns.TypeCNAME),
+			Target: target,
+		},
+		Owner: owner,
+	})
+}
+
+func (rg *RecordGenerator) header(name string, rrtype uint16) dns.RR_Header {
+	return dns.RR_Header{
+		Name:   name,
+		Rrtype: rrtype,
+		Class:  dns.ClassINET,
+		Ttl:    rg.ttl,
+	}
+}
+
+// insert adds rec to name, data identifies the record to skip duplicates,
+// e.g. identical tasks on the same slave
+func (rg *RecordGenerator) insert(name string, data string, rec Record) {
+	rrtype := rec.RR.Header().Rrtype
+	logging.VeryVerbose.Println("[" + dns.TypeToString[rrtype] + "]\t" + name + ": " + data)
+
+	key := name + "\x00" + dns.TypeToString[rrtype] + "\x00" + data
+	if _, ok := rg.keys[key]; ok {
+		return
+	}
+	rg.keys[key] = struct{}{}
+
+	set, ok := rg.Records[name]
+	if !ok {
+		set = make(RRSet)
+		rg.Records[name] = set
+	}
+	set[rrtype] = append(set[rrtype], rec)
+}
+
+// indexNames adds an empty RRSet for the parents of all the names in the
+// domain that have none, and indexes the sorted children of every name
+func (rg *RecordGenerator) indexNames(domain string) {
+	rg.children = make(map[string][]string)
+	apex := domain + "."
+
+	names := make([]string, 0, len(rg.Records))
+	for name := range rg.Records {
+		names = append(names, name)
+	}
+
+	indexed := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if !strings.HasSuffix(name, "."+apex) {
+			continue
+		}
+		for name != apex {
+			if _, ok := indexed[name]; ok {
+				break
+			}
+			indexed[name] = struct{}{}
+			if _, ok := rg.Records[name]; !ok {
+				rg.Records[name] = RRSet{}
+			}
+			parent := name[strings.Index(name, ".")+1:]
+			rg.children[parent] = append(rg.children[parent], name)
+			name = parent
+		}
+	}
+	for _, children := range rg.children {
+		sort.Strings(children)
+	}
+}
@@ -0,0 +1,95 @@
+package records
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStoreInsert(t *testing.T) {
+	rg := RecordGenerator{ttl: 60}
+	rg.Records = make(map[string]RRSet)
+	rg.keys = make(map[string]struct{})
+
+	owner := &Owner{TaskID: "app.1", Framework: "marathon"}
+	rg.insertA("app.marathon.mesos.", "10.0.0.1", owner)
+	rg.insertA("app.marathon.mesos.", "not-an-ip", owner)
+	rg.insertSRV("_app._tcp.marathon.mesos.", "app.marathon.mesos.", "31000", SRVPriority{1, 2}, owner)
+	rg.insertSRV("_app._tcp.marathon.mesos.", "app.marathon.mesos.", "31000", SRVPriority{1, 2}, owner)
+	rg.insertSRV("_app._tcp.marathon.mesos.", "app.marathon.mesos.", "99999", SRVPriority{}, owner)
+	rg.insertTXT("app.marathon.mesos.", []string{"a b"}, owner)
+	rg.insertTXT("app.marathon.mesos.", []string{"a", "b"}, owner)
+
+	as := rg.Lookup("app.marathon.mesos.", dns.TypeA)
+	if len(as) != 1 {
+		t.Fatalf("expected 1 A record instead of %d", len(as))
+	}
+	a := as[0].RR.(*dns.A)
+	if a.A.String() != "10.0.0.1" || a.Hdr.Name != "app.marathon.mesos." || a.Hdr.Ttl != 60 {
+		t.Errorf("unexpected A record %s", a)
+	}
+	if as[0].Owner != owner {
+		t.Error("should keep the owner of the record")
+	}
+
+	srvs := rg.Lookup("_app._tcp.marathon.mesos.", dns.TypeSRV)
+	if len(srvs) != 1 {
+		t.Fatalf("expected 1 SRV record instead of %d", len(srvs))
+	}
+	srv := srvs[0].RR.(*dns.SRV)
+	if srv.Target != "app.marathon.mesos." || srv.Port != 31000 || srv.Priority != 1 || srv.Weight != 2 {
+		t.Errorf("unexpected SRV record %s", srv)
+	}
+
+	if txts := rg.Lookup("app.marathon.mesos.", dns.TypeTXT); len(txts) != 2 {
+		t.Errorf("expected 2 TXT records instead of %d", len(txts))
+	}
+}
+
+func TestIndexNames(t *testing.T) {
+	rg := RecordGenerator{}
+	rg.Records = make(map[string]RRSet)
+	rg.keys = make(map[string]struct{})
+
+	rg.insertA("app.marathon.mesos.", "10.0.0.1", nil)
+	rg.insertA("marathon.mesos.", "10.0.0.2", nil)
+	rg.insertA("ns1.example.com.", "10.0.0.3", nil)
+	rg.indexNames("mesos")
+
+	if !rg.Exists("marathon.mesos.") || len(rg.Lookup("marathon.mesos.", dns.TypeA)) != 1 {
+		t.Error("should keep the records of a parent name")
+	}
+	if rg.Exists("mesos.") || rg.Exists("example.com.") {
+		t.Error("should only index the names within the domain")
+	}
+	children := rg.children["marathon.mesos."]
+	if len(children) != 1 || children[0] != "app.marathon.mesos." {
+		t.Errorf("unexpected children %q", children)
+	}
+}
+
+func TestHash(t *testing.T) {
+	sj := fakeTasksState("liquor-store", "chronos")
+
+	var a, b RecordGenerator
+	if err := a.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the order of the tasks doesn't matter
+	sj.Frameworks[0].Tasks[0], sj.Frameworks[0].Tasks[1] = sj.Frameworks[0].Tasks[1], sj.Frameworks[0].Tasks[0]
+	if err := b.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Hash() == "" || a.Hash() != b.Hash() {
+		t.Errorf("expected equal hashes instead of %q and %q", a.Hash(), b.Hash())
+	}
+
+	sj.Frameworks[0].Tasks[0].State = "TASK_FINISHED"
+	if err := b.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if a.Hash() == b.Hash() {
+		t.Error("expected different hashes for different records")
+	}
+}
@@ -0,0 +1,384 @@
+package records
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+)
+
+// The following types help parse the events of the v1 operator API
+// (Mesos 1.1 and later) in JSON format
+type v1Value struct {
+	Value string `json:"value"`
+}
+
+type v1Task struct {
+	Name        string  `json:"name"`
+	TaskID      v1Value `json:"task_id"`
+	FrameworkID v1Value `json:"framework_id"`
+	AgentID     v1Value `json:"agent_id"`
+	State       string  `json:"state"`
+	Resources   []struct {
+		Name   string `json:"name"`
+		Ranges struct {
+			Range []struct {
+				Begin uint64 `json:"begin"`
+				End   uint64 `json:"end"`
+			} `json:"range"`
+		} `json:"ranges"`
+	} `json:"resources"`
+	Labels struct {
+		Labels []Label `json:"labels"`
+	} `json:"labels"`
+}
+
+type v1Agent struct {
+	AgentInfo struct {
+		ID       v1Value `json:"id"`
+		Hostname string  `json:"hostname"`
+	} `json:"agent_info"`
+	Pid string `json:"pid"`
+}
+
+type v1FrameworkInfo struct {
+	ID       v1Value `json:"id"`
+	Name     string  `json:"name"`
+	Role     string  `json:"role"`
+	Hostname string  `json:"hostname"`
+	WebUIURL string  `json:"webui_url"`
+}
+
+type v1Framework struct {
+	FrameworkInfo v1FrameworkInfo `json:"framework_info"`
+}
+
+type v1Event struct {
+	Type       string `json:"type"`
+	Subscribed *struct {
+		GetState struct {
+			GetTasks struct {
+				Tasks []v1Task `json:"tasks"`
+			} `json:"get_tasks"`
+			GetFrameworks struct {
+				Frameworks []v1Framework `json:"frameworks"`
+			} `json:"get_frameworks"`
+			GetAgents struct {
+				Agents []v1Agent `json:"agents"`
+			} `json:"get_agents"`
+		} `json:"get_state"`
+		HeartbeatIntervalSeconds float64 `json:"heartbeat_interval_seconds"`
+	} `json:"subscribed"`
+	TaskAdded *struct {
+		Task v1Task `json:"task"`
+	} `json:"task_added"`
+	TaskUpdated *struct {
+		FrameworkID v1Value `json:"framework_id"`
+		Status      struct {
+			TaskID v1Value `json:"task_id"`
+		} `json:"status"`
+		State string `json:"state"`
+	} `json:"task_updated"`
+	AgentAdded *struct {
+		Agent v1Agent `json:"agent"`
+	} `json:"agent_added"`
+	AgentRemoved *struct {
+		AgentID v1Value `json:"agent_id"`
+	} `json:"agent_removed"`
+	FrameworkAdded *struct {
+		Framework v1Framework `json:"framework"`
+	} `json:"framework_added"`
+	FrameworkUpdated *struct {
+		Framework v1Framework `json:"framework"`
+	} `json:"framework_updated"`
+	FrameworkRemoved *struct {
+		FrameworkInfo v1FrameworkInfo `json:"framework_info"`
+	} `json:"framework_removed"`
+}
+
+// terminal task states, tasks in them are dropped from the stream state
+var terminalStates = map[string]bool{
+	"TASK_FINISHED": true,
+	"TASK_FAILED":   true,
+	"TASK_KILLED":   true,
+	"TASK_LOST":     true,
+	"TASK_ERROR":    true,
+	"TASK_DROPPED":  true,
+	"TASK_GONE":     true,
+}
+
+// DefaultStreamTimeout is how long Subscribe waits by default for the
+// response of the master and for the first event
+const DefaultStreamTimeout = 15 * time.Second
+
+// Subscribe subscribes to the events of the master at addr (ip:port) with
+// the SUBSCRIBE call of the v1 operator API. It calls update with the
+// state of the master once subscribed, and again after every event that
+// changes it; events read together are applied at once. Non-leading
+// masters redirect the subscription to the leader. Subscribe blocks until
+// the stream ends, with the error that ended it. It gives up when the
+// master doesn't answer within timeout (DefaultStreamTimeout if 0), or
+// then sends no event for three heartbeat intervals, and stops when parent
+// is done, with its error.
+func Subscribe(parent context.Context, addr string, timeout time.Duration, update func(StateJSON)) error {
+	if timeout <= 0 {
+		timeout = DefaultStreamTimeout
+	}
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	// cancels the subscription when the master goes quiet
+	watchdog := time.AfterFunc(timeout, cancel)
+	defer watchdog.Stop()
+
+	body := []byte(`{"type":"SUBSCRIBE"}`)
+	req, err := http.NewRequest("POST", "http://"+addr+"/api/v1", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if parent.Err() != nil {
+			return parent.Err()
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("subscribing to %s: %s", addr, resp.Status)
+	}
+
+	// the leader, after following redirects
+	leader := resp.Request.URL.Host
+	logging.Verbose.Println("subscribed to the events of master " + leader)
+
+	state := newStreamState("master@" + leaderAddr(leader))
+	r := bufio.NewReader(resp.Body)
+	changed := false
+	for {
+		record, err := readRecord(r)
+		if err != nil {
+			if parent.Err() != nil {
+				return parent.Err()
+			}
+			if ctx.Err() != nil {
+				return errors.New("no events from master " + leader)
+			}
+			return err
+		}
+
+		var e v1Event
+		if err := json.Unmarshal(record, &e); err != nil {
+			return err
+		}
+		if e.Type == "SUBSCRIBED" && e.Subscribed != nil && e.Subscribed.HeartbeatIntervalSeconds > 0 {
+			timeout = 3 * time.Duration(e.Subscribed.HeartbeatIntervalSeconds*float64(time.Second))
+		}
+		watchdog.Reset(timeout)
+
+		if state.apply(&e) {
+			changed = true
+		}
+		// wait for the events that already arrived
+		if changed && r.Buffered() == 0 {
+			update(state.stateJSON())
+			changed = false
+		}
+	}
+}
+
+// leaderAddr returns the ip:port of the master at hostport, like the leader
+// of state.json, resolving its host name. it returns hostport itself if the
+// name doesn't resolve.
+func leaderAddr(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return hostport
+	}
+	ip, ok := hostToIP4(host)
+	if !ok {
+		return hostport
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// readRecord reads a RecordIO record, i.e. its length in bytes followed by
+// a newline and the record itself
+func readRecord(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(line), 10, 31)
+	if err != nil {
+		return nil, fmt.Errorf("invalid record length %q", line)
+	}
+	record := make([]byte, n)
+	if _, err := io.ReadFull(r, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// streamState is the state of a master, kept up to date with its events
+type streamState struct {
+	leader     string
+	frameworks map[string]v1FrameworkInfo
+	agents     map[string]v1Agent
+	tasks      map[string]v1Task // by framework and task id
+}
+
+func newStreamState(leader string) *streamState {
+	return &streamState{
+		leader:     leader,
+		frameworks: make(map[string]v1FrameworkInfo),
+		agents:     make(map[string]v1Agent),
+		tasks:      make(map[string]v1Task),
+	}
+}
+
+// apply applies an event to the state and returns true if it changed it
+func (s *streamState) apply(e *v1Event) bool {
+	switch {
+	case e.Subscribed != nil:
+		st := e.Subscribed.GetState
+		s.frameworks = make(map[string]v1FrameworkInfo)
+		s.agents = make(map[string]v1Agent)
+		s.tasks = make(map[string]v1Task)
+		for _, f := range st.GetFrameworks.Frameworks {
+			s.frameworks[f.FrameworkInfo.ID.Value] = f.FrameworkInfo
+		}
+		for _, a := range st.GetAgents.Agents {
+			s.agents[a.AgentInfo.ID.Value] = a
+		}
+		for _, t := range st.GetTasks.Tasks {
+			s.addTask(t)
+		}
+	case e.TaskAdded != nil:
+		s.addTask(e.TaskAdded.Task)
+	case e.TaskUpdated != nil:
+		key := e.TaskUpdated.FrameworkID.Value + "/" + e.TaskUpdated.Status.TaskID.Value
+		t, ok := s.tasks[key]
+		if !ok {
+			return false
+		}
+		t.State = e.TaskUpdated.State
+		s.addTask(t)
+	case e.AgentAdded != nil:
+		a := e.AgentAdded.Agent
+		s.agents[a.AgentInfo.ID.Value] = a
+	case e.AgentRemoved != nil:
+		delete(s.agents, e.AgentRemoved.AgentID.Value)
+	case e.FrameworkAdded != nil:
+		f := e.FrameworkAdded.Framework.FrameworkInfo
+		s.frameworks[f.ID.Value] = f
+	case e.FrameworkUpdated != nil:
+		f := e.FrameworkUpdated.Framework.FrameworkInfo
+		s.frameworks[f.ID.Value] = f
+	case e.FrameworkRemoved != nil:
+		delete(s.frameworks, e.FrameworkRemoved.FrameworkInfo.ID.Value)
+	default:
+		// HEARTBEAT and events that don't affect the records
+		return false
+	}
+	return true
+}
+
+// addTask adds or replaces a task, or drops it if it is terminal
+func (s *streamState) addTask(t v1Task) {
+	key := t.FrameworkID.Value + "/" + t.TaskID.Value
+	if terminalStates[t.State] {
+		delete(s.tasks, key)
+	} else {
+		s.tasks[key] = t
+	}
+}
+
+// stateJSON returns the state in the format of state.json, with the
+// frameworks and tasks sorted by id so that equal states generate equal
+// records
+func (s *streamState) stateJSON() StateJSON {
+	sj := StateJSON{Leader: s.leader}
+
+	aids := make([]string, 0, len(s.agents))
+	for id := range s.agents {
+		aids = append(aids, id)
+	}
+	sort.Strings(aids)
+	for _, id := range aids {
+		a := s.agents[id]
+		sj.Slaves = append(sj.Slaves, slave{Id: id, Hostname: a.AgentInfo.Hostname, Pid: a.Pid})
+	}
+
+	fids := make([]string, 0, len(s.frameworks))
+	for id := range s.frameworks {
+		fids = append(fids, id)
+	}
+	sort.Strings(fids)
+	index := make(map[string]int, len(fids))
+	sj.Frameworks = make(Frameworks, len(fids))
+	for i, id := range fids {
+		f := s.frameworks[id]
+		index[id] = i
+		sj.Frameworks[i].Name = f.Name
+		sj.Frameworks[i].Role = f.Role
+		sj.Frameworks[i].Hostname = f.Hostname
+		sj.Frameworks[i].WebUIURL = f.WebUIURL
+	}
+
+	keys := make([]string, 0, len(s.tasks))
+	for key := range s.tasks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		t := s.tasks[key]
+		i, ok := index[t.FrameworkID.Value]
+		if !ok {
+			continue
+		}
+		tasks := make(Tasks, 1)
+		tasks[0].FrameworkId = t.FrameworkID.Value
+		tasks[0].Id = t.TaskID.Value
+		tasks[0].Name = t.Name
+		tasks[0].SlaveId = t.AgentID.Value
+		tasks[0].State = t.State
+		tasks[0].Resources.Ports = t.ports()
+		tasks[0].Labels = t.Labels.Labels
+		sj.Frameworks[i].Tasks = append(sj.Frameworks[i].Tasks, tasks[0])
+	}
+	return sj
+}
+
+// ports returns the port ranges of the task in the format of state.json,
+// e.g. "[31000-31000, 31005-31006]", or "" if it has none
+func (t *v1Task) ports() string {
+	var ranges []string
+	for _, r := range t.Resources {
+		if r.Name != "ports" {
+			continue
+		}
+		for _, pr := range r.Ranges.Range {
+			ranges = append(ranges, strconv.FormatUint(pr.Begin, 10)+"-"+strconv.FormatUint(pr.End, 10))
+		}
+	}
+	if len(ranges) == 0 {
+		return ""
+	}
+	return "[" + strings.Join(ranges, ", ") + "]"
+}
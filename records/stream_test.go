@@ -0,0 +1,200 @@
+package records
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeStreamMaster is a mesos master serving the events sent to its events
+// channel as the RecordIO stream of the v1 operator API, until the channel
+// is closed
+type fakeStreamMaster struct {
+	*httptest.Server
+	events chan string
+}
+
+func newFakeStreamMaster() *fakeStreamMaster {
+	m := &fakeStreamMaster{events: make(chan string)}
+	m.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call struct{ Type string }
+		if r.Method != "POST" || r.URL.Path != "/api/v1" {
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&call); err != nil || call.Type != "SUBSCRIBE" {
+			http.Error(w, "expected a SUBSCRIBE call", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for e := range m.events {
+			fmt.Fprintf(w, "%d\n%s", len(e), e)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	return m
+}
+
+func (m *fakeStreamMaster) addr() string {
+	return m.Listener.Addr().String()
+}
+
+const (
+	fakeSubscribed = `{"type":"SUBSCRIBED","subscribed":{"get_state":{
+		"get_tasks":{"tasks":[{"name":"liquor-store","task_id":{"value":"liquor-store.1"},
+			"framework_id":{"value":"f1"},"agent_id":{"value":"a1"},"state":"TASK_RUNNING",
+			"resources":[{"name":"cpus","scalar":{"value":1}},
+				{"name":"ports","ranges":{"range":[{"begin":31000,"end":31001}]}}],
+			"labels":{"labels":[{"key":"VERSION","value":"1.2"}]}}]},
+		"get_frameworks":{"frameworks":[{"framework_info":{"id":{"value":"f1"},"name":"marathon"}}]},
+		"get_agents":{"agents":[{"agent_info":{"id":{"value":"a1"},"hostname":"1.2.3.11"},"pid":"slave(1)@1.2.3.11:5051"}]}},
+		"heartbeat_interval_seconds":15}}`
+	fakeTaskAdded = `{"type":"TASK_ADDED","task_added":{"task":{"name":"chronos",
+		"task_id":{"value":"chronos.1"},"framework_id":{"value":"f1"},"agent_id":{"value":"a2"},
+		"state":"TASK_STAGING"}}}`
+	fakeAgentAdded = `{"type":"AGENT_ADDED","agent_added":{"agent":{
+		"agent_info":{"id":{"value":"a2"},"hostname":"1.2.3.12"},"pid":"slave(1)@1.2.3.12:5051"}}}`
+	fakeTaskRunning = `{"type":"TASK_UPDATED","task_updated":{"framework_id":{"value":"f1"},
+		"status":{"task_id":{"value":"chronos.1"},"state":"TASK_RUNNING"},"state":"TASK_RUNNING"}}`
+	fakeTaskKilled = `{"type":"TASK_UPDATED","task_updated":{"framework_id":{"value":"f1"},
+		"status":{"task_id":{"value":"liquor-store.1"},"state":"TASK_KILLED"},"state":"TASK_KILLED"}}`
+	fakeHeartbeat = `{"type":"HEARTBEAT"}`
+)
+
+func TestSubscribe(t *testing.T) {
+	m := newFakeStreamMaster()
+	defer m.Close()
+
+	updates := make(chan StateJSON)
+	done := make(chan error)
+	go func() {
+		done <- Subscribe(context.Background(), m.addr(), time.Second, func(sj StateJSON) { updates <- sj })
+	}()
+
+	// records of the state after each update
+	records := func() RecordGenerator {
+		var rg RecordGenerator
+		if err := rg.InsertState(<-updates, fakeConfig()); err != nil {
+			t.Fatal(err)
+		}
+		return rg
+	}
+
+	m.events <- fakeSubscribed
+	rg := records()
+	if len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA)) != 1 {
+		t.Error("should find the running task of the initial state - A record")
+	}
+	if srvs := rg.Lookup("_liquor-store._tcp.marathon.mesos.", dns.TypeSRV); len(srvs) != 2 {
+		t.Errorf("should find both ports of the task - SRV record, found %d", len(srvs))
+	}
+	if len(rg.Lookup("leader.mesos.", dns.TypeA)) != 1 {
+		t.Error("should find the leader - A record")
+	}
+
+	m.events <- fakeTaskAdded
+	if rg = records(); len(rg.Lookup("chronos.marathon.mesos.", dns.TypeA)) != 0 {
+		t.Error("should not find the staging task - A record")
+	}
+	m.events <- fakeHeartbeat
+	m.events <- fakeAgentAdded
+	rg = records()
+	m.events <- fakeTaskRunning
+	if rg = records(); len(rg.Lookup("chronos.marathon.mesos.", dns.TypeA)) != 1 {
+		t.Error("should find the task once running - A record")
+	}
+	m.events <- fakeTaskKilled
+	if rg = records(); len(rg.Lookup("liquor-store.marathon.mesos.", dns.TypeA)) != 0 {
+		t.Error("should not find the killed task - A record")
+	}
+
+	close(m.events)
+	if err := <-done; err == nil {
+		t.Error("expected an error when the stream ends")
+	}
+
+	// a master reached by host name leads by address, like in state.json
+	m = newFakeStreamMaster()
+	defer m.Close()
+	_, port, _ := net.SplitHostPort(m.addr())
+	go func() {
+		done <- Subscribe(context.Background(), "localhost:"+port, time.Second, func(sj StateJSON) { updates <- sj })
+	}()
+	m.events <- fakeSubscribed
+	rg = records()
+	if a := rg.Lookup("leader.mesos.", dns.TypeA); len(a) != 1 || a[0].RR.(*dns.A).A.String() != "127.0.0.1" {
+		t.Errorf("should find the address of the leader - A record, found %v", a)
+	}
+	if len(rg.Lookup("_leader._tcp.mesos.", dns.TypeSRV)) != 1 {
+		t.Error("should find the port of the leader - SRV record")
+	}
+	close(m.events)
+	<-done
+}
+
+func TestSubscribeUnavailable(t *testing.T) {
+	// masters older than 1.1 don't have the operator API
+	m := httptest.NewServer(http.NotFoundHandler())
+	defer m.Close()
+
+	err := Subscribe(context.Background(), m.Listener.Addr().String(), time.Second, func(StateJSON) {
+		t.Error("should not update the state")
+	})
+	if err == nil {
+		t.Error("expected an error without the operator API")
+	}
+}
+
+func TestSubscribeTimeout(t *testing.T) {
+	m := newFakeStreamMaster()
+	defer m.Close()
+	defer close(m.events)
+
+	start := time.Now()
+	err := Subscribe(context.Background(), m.addr(), 50*time.Millisecond, func(StateJSON) {})
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("expected to give up on a quiet master, got %v", err)
+	}
+}
+
+func TestSubscribeCanceled(t *testing.T) {
+	m := newFakeStreamMaster()
+	defer m.Close()
+	defer close(m.events)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- Subscribe(ctx, m.addr(), time.Minute, func(StateJSON) {})
+	}()
+	m.events <- fakeSubscribed
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("expected the subscription to be canceled instead of %v", err)
+	}
+}
+
+func TestReadRecord(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("5\nhello3\nfoo\nbar"))
+	for _, expected := range []string{"hello", "foo"} {
+		record, err := readRecord(r)
+		if err != nil || string(record) != expected {
+			t.Errorf("expected record %q instead of %q (%v)", expected, record, err)
+		}
+	}
+	if _, err := readRecord(r); err == nil {
+		t.Error("expected an error for an invalid record length")
+	}
+}
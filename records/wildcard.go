@@ -0,0 +1,91 @@
+package records
+
+import (
+	"strings"
+)
+
+// MaxWildcardNames is the most names a wildcard matches, so that a query
+// for "*.mesos." doesn't get every record of the domain
+const MaxWildcardNames = 100
+
+// Match returns the names matching a name in the domain. A "*" label in
+// name matches one or more labels, so "*.marathon.mesos." matches every
+// name within marathon.mesos. and "_app._tcp.*.mesos." matches the SRV
+// records of app in every framework, up to MaxWildcardNames names: the
+// first ones in the order of the names, so that the same records always
+// match the same names. Names without wildcards match themselves if they
+// exist.
+func (rg *RecordGenerator) Match(name, domain string) []string {
+	apex := domain + "."
+	if !strings.Contains(name, "*") {
+		if rg.Exists(name) || name == apex {
+			return []string{name}
+		}
+		return nil
+	}
+	if !strings.HasSuffix(name, "."+apex) {
+		return nil
+	}
+
+	// match the labels right to left, starting from the domain
+	labels := strings.Split(strings.TrimSuffix(name, "."+apex), ".")
+	matches := []string{apex}
+	for i := len(labels) - 1; i >= 0 && len(matches) > 0; i-- {
+		// the names matching the leftmost label are the answer, the
+		// others are filtered by the labels further left
+		limit := -1
+		if i == 0 {
+			limit = MaxWildcardNames
+		}
+		var next []string
+		if labels[i] == "*" {
+			seen := make(map[string]struct{})
+			for _, m := range matches {
+				next = rg.descendants(m, next, seen, limit)
+			}
+		} else {
+			for _, m := range matches {
+				if rg.Exists(labels[i] + "." + m) {
+					next = append(next, labels[i]+"."+m)
+				}
+			}
+		}
+		matches = dedup(next)
+	}
+	if len(matches) > MaxWildcardNames {
+		matches = matches[:MaxWildcardNames]
+	}
+	return matches
+}
+
+// descendants appends the names below name that aren't in seen to names,
+// depth first in the order of the children, until names has limit names
+// (no limit if negative). consecutive wildcards can reach a name more than
+// once, seen skips the names already appended along with their descendants.
+func (rg *RecordGenerator) descendants(name string, names []string, seen map[string]struct{}, limit int) []string {
+	for _, child := range rg.children[name] {
+		if limit >= 0 && len(names) >= limit {
+			break
+		}
+		if _, ok := seen[child]; ok {
+			continue
+		}
+		seen[child] = struct{}{}
+		names = append(names, child)
+		names = rg.descendants(child, names, seen, limit)
+	}
+	return names
+}
+
+// dedup removes duplicate names
+func dedup(names []string) []string {
+	seen := make(map[string]struct{}, len(names))
+	unique := names[:0]
+	for _, name := range names {
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			unique = append(unique, name)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,68 @@
+package records
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	sj := fakeTasksState("liquor-store", "chronos")
+	sj.Frameworks = append(sj.Frameworks, sj.Frameworks[0])
+	sj.Frameworks[1].Name = "marathon.prod"
+
+	rg := RecordGenerator{}
+	if err := rg.InsertState(sj, fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][]string{
+		"chronos.marathon.mesos.": {"chronos.marathon.mesos."},
+		"missing.marathon.mesos.": nil,
+		"mesos.":                  {"mesos."},
+		"*.missing.mesos.":        nil,
+		"*.prod.mesos.": {
+			"marathon.prod.mesos.",
+			"chronos.marathon.prod.mesos.",
+			"chronos-26377-1.marathon.prod.mesos.",
+			"liquor-store.marathon.prod.mesos.",
+			"liquor-store-33856-0.marathon.prod.mesos.",
+		},
+		"liquor-store.*.mesos.": {
+			"liquor-store.marathon.mesos.",
+			"liquor-store.marathon.prod.mesos.",
+		},
+		"chronos.*.*.mesos.": {
+			"chronos.marathon.prod.mesos.",
+		},
+	}
+	for name, expected := range tests {
+		actual := rg.Match(name, "mesos")
+		sort.Strings(actual)
+		sort.Strings(expected)
+		if !equalStrings(actual, expected) {
+			t.Errorf("expected %q instead of %q for %s", expected, actual, name)
+		}
+	}
+
+	names := make([]string, 2*MaxWildcardNames)
+	for i := range names {
+		names[i] = "task" + strconv.Itoa(i)
+	}
+	rg = RecordGenerator{}
+	if err := rg.InsertState(fakeTasksState(names...), fakeConfig()); err != nil {
+		t.Fatal(err)
+	}
+	matches := rg.Match("*.marathon.mesos.", "mesos")
+	if len(matches) != MaxWildcardNames {
+		t.Errorf("expected at most %d names matching a wildcard instead of %d", MaxWildcardNames, len(matches))
+	}
+	for i := 0; i < 10; i++ {
+		if again := rg.Match("*.marathon.mesos.", "mesos"); !equalStrings(again, matches) {
+			t.Fatalf("expected the same names matching a wildcard instead of %q", again)
+		}
+	}
+	if n := len(rg.Match("*.*.mesos.", "mesos")); n != MaxWildcardNames {
+		t.Errorf("expected %d names matching consecutive wildcards instead of %d", MaxWildcardNames, n)
+	}
+}
@@ -0,0 +1,132 @@
+package resolver
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/emicklei/go-restful"
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+// acl holds the networks of the clients allowed to do something, nil
+// allows all clients
+type acl []*net.IPNet
+
+// acls restrict the clients of the resolver, see records.ACLs
+type acls struct {
+	query     acl
+	recursion acl
+	transfer  acl
+	http      map[string]acl
+}
+
+func newACL(networks []string) acl {
+	nets, err := records.ParseNetworks(networks)
+	if err != nil {
+		// the config is validated, but for resolvers embedded with a
+		// config of their own
+		logging.Error.Println(err.Error() + ", allowing no client")
+		return acl{}
+	}
+	return acl(nets)
+}
+
+func newACLs(c records.ACLs) acls {
+	a := acls{
+		query:     newACL(c.Query),
+		recursion: newACL(c.Recursion),
+		transfer:  newACL(c.Transfer),
+		http:      make(map[string]acl, len(c.HTTP)),
+	}
+	for route, networks := range c.HTTP {
+		a.http[route] = newACL(networks)
+	}
+	return a
+}
+
+// allows returns true if ip is in one of the networks of the acl
+func (a acl) allows(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	for _, n := range a {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forRoute returns the acl of an HTTP route, the one of "*" unless it has
+// one of its own
+func (a acls) forRoute(route string) acl {
+	if routeACL, ok := a.http[route]; ok {
+		return routeACL
+	}
+	return a.http["*"]
+}
+
+// allowsZone returns true if the client at ip may ask q of a Mesos domain
+// or stub zone, zone transfers (AXFR and IXFR) only if the transfer acl
+// allows it too
+func (a acls) allowsZone(ip net.IP, q dns.Question) bool {
+	if q.Qtype == dns.TypeAXFR || q.Qtype == dns.TypeIXFR {
+		return a.query.allows(ip) && a.transfer.allows(ip)
+	}
+	return a.query.allows(ip)
+}
+
+// allowsRecursion returns true if the client at ip may have q forwarded
+func (a acls) allowsRecursion(ip net.IP, q dns.Question) bool {
+	return a.recursion.allows(ip)
+}
+
+// restrict returns a handler which refuses the questions that allowed
+// returns false for, and passes the others on to h
+func (res *Resolver) restrict(allowed func(net.IP, dns.Question) bool, h func(dns.ResponseWriter, *dns.Msg)) func(dns.ResponseWriter, *dns.Msg) {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if len(r.Question) == 0 || allowed(addrIP(w.RemoteAddr()), r.Question[0]) {
+			h(w, r)
+			return
+		}
+		res.metrics.Refused.Inc()
+		logging.VeryVerbose.Println("Warning: refused " + r.Question[0].Name + " to " + w.RemoteAddr().String())
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeRefused)
+		if err := w.WriteMsg(m); err != nil {
+			logging.Error.Println(err)
+		}
+	}
+}
+
+// restrictHTTP returns a filter which forbids route to the clients its
+// acl doesn't allow
+func (res *Resolver) restrictHTTP(route string) restful.FilterFunction {
+	a := res.acls.forRoute(route)
+	return func(req *restful.Request, resp *restful.Response, chain *restful.FilterChain) {
+		var ip net.IP
+		if host, _, err := net.SplitHostPort(req.Request.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+		if !a.allows(ip) {
+			res.metrics.Refused.Inc()
+			logging.VeryVerbose.Println("Warning: forbidden " + route + " to " + req.Request.RemoteAddr)
+			resp.WriteErrorString(http.StatusForbidden, "403: Forbidden")
+			return
+		}
+		chain.ProcessFilter(req, resp)
+	}
+}
+
+// addrIP returns the IP address of a UDP or TCP address, or nil
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	return nil
+}
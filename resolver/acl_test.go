@@ -0,0 +1,89 @@
+package resolver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+func TestHTTPRoutes(t *testing.T) {
+	res := New("", records.Config{Domain: "mesos"})
+	var routes []string
+	for _, ws := range res.container.RegisteredWebServices() {
+		for _, r := range ws.Routes() {
+			routes = append(routes, r.Path)
+		}
+	}
+	if !reflect.DeepEqual(routes, records.HTTPRoutes) {
+		t.Errorf("expected the routes %q instead of %q", records.HTTPRoutes, routes)
+	}
+}
+
+func TestACLs(t *testing.T) {
+	config := records.Config{
+		Domain:     "mesos",
+		TTL:        60,
+		SOARname:   "root.ns1.mesos.",
+		SOAMname:   "ns1.mesos.",
+		ExternalOn: true,
+		ACLs: records.ACLs{
+			Query:     []string{"127.0.0.0/8"},
+			Recursion: []string{},
+			Transfer:  []string{"10.0.0.1"},
+			HTTP: map[string][]string{
+				"/v1/config": {"127.0.0.1"},
+				"*":          {"192.0.2.0/24"},
+			},
+		},
+	}
+	res := New("", config)
+	res.zones[0].publish(&records.RecordGenerator{})
+
+	// the fake writer is at 127.0.0.1
+	for _, q := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"leader.mesos.", dns.TypeA, dns.RcodeNameError},
+		{"mesos.", dns.TypeAXFR, dns.RcodeRefused},
+		{"example.com.", dns.TypeA, dns.RcodeRefused},
+	} {
+		w := &fakeWriter{}
+		res.DNSHandler().ServeDNS(w, new(dns.Msg).SetQuestion(q.name, q.qtype))
+		if w.msg.Rcode != q.rcode {
+			t.Errorf("expected %s for %s %s instead of %s", dns.RcodeToString[q.rcode], q.name,
+				dns.TypeToString[q.qtype], dns.RcodeToString[w.msg.Rcode])
+		}
+	}
+	if got := res.Metrics().Refused.(*logging.LogCounter).String(); got != "2" {
+		t.Errorf("expected 2 refused requests instead of %s", got)
+	}
+
+	// transfers aren't supported, even once allowed
+	config.ACLs.Transfer = []string{"127.0.0.1"}
+	res = New("", config)
+	res.zones[0].publish(&records.RecordGenerator{})
+	w := &fakeWriter{}
+	res.DNSHandler().ServeDNS(w, new(dns.Msg).SetQuestion("mesos.", dns.TypeAXFR))
+	if w.msg.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("expected NOTIMP for an allowed transfer instead of %s", dns.RcodeToString[w.msg.Rcode])
+	}
+
+	// httptest requests are from 192.0.2.1
+	for path, code := range map[string]int{
+		"/v1/config":  http.StatusForbidden,
+		"/v1/version": http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		res.HTTPHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != code {
+			t.Errorf("expected %d for %s instead of %d", code, path, w.Code)
+		}
+	}
+}
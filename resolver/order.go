@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+// answerOrder reorders the answers to a query for name
+type answerOrder func(name string, answers []dns.RR) []dns.RR
+
+// newAnswerOrder returns the answer order of the records rs for the given
+// strategy, one of "random", "roundrobin" and "none". It defaults to
+// "random".
+func newAnswerOrder(strategy string, rs *records.RecordGenerator) answerOrder {
+	switch strategy {
+	case "none":
+		return func(_ string, answers []dns.RR) []dns.RR { return answers }
+	case "roundrobin":
+		return newRoundRobin(rs).order
+	default:
+		return func(_ string, answers []dns.RR) []dns.RR { return shuffleAnswers(answers) }
+	}
+}
+
+// reorders answers for very basic load balancing
+func shuffleAnswers(answers []dns.RR) []dns.RR {
+	rand.Seed(time.Now().UTC().UnixNano())
+
+	n := len(answers)
+	for i := 0; i < n; i++ {
+		r := i + rand.Intn(n-i)
+		answers[r], answers[i] = answers[i], answers[r]
+	}
+
+	return answers
+}
+
+// roundRobin rotates the answers for every name of its records by one on
+// each query. the answers for other names, e.g. wildcards, keep their order
+// so that queries for random names don't grow next.
+type roundRobin struct {
+	sync.Mutex
+	rs   *records.RecordGenerator
+	next map[string]int
+}
+
+func newRoundRobin(rs *records.RecordGenerator) *roundRobin {
+	return &roundRobin{rs: rs, next: make(map[string]int)}
+}
+
+func (rr *roundRobin) order(name string, answers []dns.RR) []dns.RR {
+	n := len(answers)
+	if n < 2 || !rr.rs.Exists(name) {
+		return answers
+	}
+
+	rr.Lock()
+	i := rr.next[name] % n
+	rr.next[name] = i + 1
+	rr.Unlock()
+
+	rotated := make([]dns.RR, 0, n)
+	rotated = append(rotated, answers[i:]...)
+	return append(rotated, answers[:i]...)
+}
@@ -0,0 +1,89 @@
+package resolver
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+func TestShuffleAnswers(t *testing.T) {
+	m := new(dns.Msg)
+	m.Answer = fakeAnswers(10)
+
+	n := new(dns.Msg)
+	c := make([]dns.RR, len(m.Answer))
+	copy(c, m.Answer)
+	n.Answer = c
+
+	_ = shuffleAnswers(m.Answer)
+
+	sflag := false
+	// 10! chance of failing here
+	for i := 0; i < 10; i++ {
+		if n.Answer[i] != m.Answer[i] {
+			sflag = true
+			break
+		}
+	}
+
+	if !sflag {
+		t.Error("not shuffling")
+	}
+}
+
+func fakeAnswers(n int) []dns.RR {
+	answers := make([]dns.RR, 0, n)
+	for i := 0; i < n; i++ {
+		answers = append(answers, &dns.A{
+			Hdr: dns.RR_Header{Name: "blah.com.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.ParseIP("10.0.0." + strconv.Itoa(i)).To4(),
+		})
+	}
+	return answers
+}
+
+func TestRoundRobinAnswers(t *testing.T) {
+	rs := &records.RecordGenerator{Records: map[string]records.RRSet{"blah.com.": {}, "other.com.": {}}}
+	rr := newRoundRobin(rs)
+	order := rr.order
+
+	for i := 0; i < 6; i++ {
+		answers := order("blah.com.", fakeAnswers(3))
+		first := answers[0].(*dns.A).A.String()
+		if expected := "10.0.0." + strconv.Itoa(i%3); first != expected {
+			t.Fatalf("expected %s first instead of %s", expected, first)
+		}
+	}
+
+	// names rotate independently
+	answers := order("other.com.", fakeAnswers(3))
+	if first := answers[0].(*dns.A).A.String(); first != "10.0.0.0" {
+		t.Errorf("expected 10.0.0.0 first instead of %s", first)
+	}
+
+	// names without records, e.g. wildcards, keep their order and aren't
+	// tracked
+	for i := 0; i < 2; i++ {
+		answers = order("*.blah.com.", fakeAnswers(3))
+		if first := answers[0].(*dns.A).A.String(); first != "10.0.0.0" {
+			t.Errorf("expected 10.0.0.0 first instead of %s", first)
+		}
+	}
+	if len(rr.next) != 2 {
+		t.Errorf("expected the names with records only, found %v", rr.next)
+	}
+}
+
+func TestNoAnswerOrder(t *testing.T) {
+	order := newAnswerOrder("none", &records.RecordGenerator{})
+
+	answers := order("blah.com.", fakeAnswers(10))
+	for i, rr := range answers {
+		if ip := rr.(*dns.A).A.String(); ip != "10.0.0."+strconv.Itoa(i) {
+			t.Fatalf("not keeping the order of answers, found %s at %d", ip, i)
+		}
+	}
+}
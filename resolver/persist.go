@@ -0,0 +1,124 @@
+package resolver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+)
+
+// savedSnapshot is a snapshot in the format it is saved to disk
+type savedSnapshot struct {
+	Serial  uint32
+	Changed time.Time
+	Checked time.Time
+	Records records.SavedRecords
+}
+
+// snapshotFile returns the file the snapshot of the zone is saved to, or
+// "" if snapshots aren't saved
+func (z *zone) snapshotFile() string {
+	if z.config.SnapshotDir == "" {
+		return ""
+	}
+	return filepath.Join(z.config.SnapshotDir, z.config.Domain+".json")
+}
+
+// save writes the snapshot to its file atomically: a temporary file is
+// written and synced first, then renamed to replace the previous snapshot
+func (z *zone) save(snap *snapshot, checked time.Time) error {
+	path := z.snapshotFile()
+	if path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(savedSnapshot{
+		Serial:  snap.serial,
+		Changed: snap.changed,
+		Checked: checked,
+		Records: snap.rs.Save(z.config.Domain),
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// touch records checked as the time of the last reload of the saved
+// snapshot, as the modification time of its file, which is saved in full
+// if it is missing
+func (z *zone) touch(snap *snapshot, checked time.Time) error {
+	path := z.snapshotFile()
+	if path == "" {
+		return nil
+	}
+	err := os.Chtimes(path, checked, checked)
+	if os.IsNotExist(err) {
+		return z.save(snap, checked)
+	}
+	return err
+}
+
+// restore loads the snapshot saved by a previous run. it is served as
+// stale records, checked when they were last reloaded, until the first
+// reload.
+func (z *zone) restore() error {
+	path := z.snapshotFile()
+	if path == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var saved savedSnapshot
+	if err = json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil && fi.ModTime().After(saved.Checked) {
+		saved.Checked = fi.ModTime()
+	}
+	if saved.Records.Domain != z.config.Domain {
+		return errors.New("snapshot " + path + " of another domain " + saved.Records.Domain)
+	}
+	rs, err := saved.Records.Load()
+	if err != nil {
+		return err
+	}
+
+	serial := saved.Serial
+	if cur := z.snapshot().serial; serial < cur {
+		serial = cur
+	}
+	z.snap.Store(z.newSnapshot(rs, serial, saved.Changed))
+	z.checked.Store(saved.Checked)
+	z.failure.Store("not reloaded since restored from " + path)
+	logging.Verbose.Println("restored the records of " + z.apex + " from " + path + ", checked " + formatTime(saved.Checked))
+	return nil
+}
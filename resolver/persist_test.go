@@ -0,0 +1,82 @@
+package resolver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+func TestPersistSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mesos-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := records.Config{
+		TTL:         60,
+		Domain:      "mesos",
+		Listener:    "127.0.0.1",
+		SOARname:    "root.ns1.mesos.",
+		SOAMname:    "ns1.mesos.",
+		StateFile:   "../factories/fake.json",
+		SnapshotDir: dir,
+	}
+	res := New("", config)
+	res.Reload()
+	saved := res.zones[0].snapshot()
+	path := filepath.Join(dir, "mesos.json")
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("expected a saved snapshot: %v", err)
+	}
+
+	// unchanged records only update the time of the last reload
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	res.Reload()
+	if fi, err := os.Stat(path); err != nil || !fi.ModTime().After(old) {
+		t.Errorf("expected the time of the reload to be saved: %v", err)
+	}
+	if b2, _ := ioutil.ReadFile(path); string(b2) != string(b) {
+		t.Error("should not save unchanged records again")
+	}
+
+	// restarts without a master
+	config.StateFile = filepath.Join(dir, "missing.json")
+	res = New("", config)
+	z := res.zones[0]
+	if snap := z.snapshot(); snap.serial != saved.serial || snap.rs.Hash() != saved.rs.Hash() {
+		t.Errorf("expected the saved snapshot %d instead of %d", saved.serial, snap.serial)
+	}
+	if checked := z.checked.Load().(time.Time); checked.Before(time.Now().Add(-time.Minute)) {
+		t.Errorf("expected the restored records to be checked at the last reload instead of %v", checked)
+	}
+	if status := z.status(); status["Healthy"] != false || status["Serving"] != true {
+		t.Errorf("expected the restored records to be served as stale instead of %v", status)
+	}
+	w := &fakeWriter{}
+	res.HandleMesos(w, new(dns.Msg).SetQuestion("liquor-store.marathon.mesos.", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) == 0 {
+		t.Errorf("expected answers from the restored records instead of %v", w.msg)
+	}
+
+	res.Reload()
+	if z.snapshot().rs.Hash() != saved.rs.Hash() {
+		t.Error("should keep the restored records when the reload fails")
+	}
+
+	// snapshots of other domains are ignored
+	config.Domain = "east.mesos"
+	os.Rename(filepath.Join(dir, "mesos.json"), filepath.Join(dir, "east.mesos.json"))
+	if res = New("", config); res.zones[0].available() {
+		t.Error("should not restore the snapshot of another domain")
+	}
+}
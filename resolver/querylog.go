@@ -0,0 +1,73 @@
+package resolver
+
+import (
+	"net"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/miekg/dns"
+)
+
+// logQuery returns a handler which passes the queries on to h and logs a
+// sample of them, along with the handler that served them, to the query
+// log if there is one
+func (res *Resolver) logQuery(handler string, h func(dns.ResponseWriter, *dns.Msg)) func(dns.ResponseWriter, *dns.Msg) {
+	if res.queryLog == nil {
+		return h
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !res.queryLog.Sampled() {
+			h(w, r)
+			return
+		}
+		start := time.Now()
+		qw := &queryWriter{ResponseWriter: w}
+		h(qw, r)
+
+		q := &logging.Query{
+			Time:     start,
+			Client:   addrIP(w.RemoteAddr()).String(),
+			Proto:    "udp",
+			Latency:  float64(time.Since(start)) / float64(time.Millisecond),
+			Handler:  handler,
+			Upstream: qw.upstream,
+			Dropped:  qw.msg == nil,
+		}
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			q.Proto = "tcp"
+		}
+		if len(r.Question) > 0 {
+			q.Name = r.Question[0].Name
+			q.Type = dns.TypeToString[r.Question[0].Qtype]
+		}
+		if qw.msg != nil {
+			q.Rcode = dns.RcodeToString[qw.msg.Rcode]
+			q.Answers = len(qw.msg.Answer)
+		}
+		res.queryLog.Log(q)
+	}
+}
+
+// queryWriter keeps the response written for the query log, along with
+// the upstream server that answered, see setUpstream
+type queryWriter struct {
+	dns.ResponseWriter
+	msg      *dns.Msg
+	upstream string
+}
+
+func (w *queryWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// setUpstream records the server that answered the query written to w in
+// the query log, if it is logged
+func setUpstream(w dns.ResponseWriter, upstream string) {
+	if rw, ok := w.(*rrlWriter); ok {
+		w = rw.ResponseWriter
+	}
+	if qw, ok := w.(*queryWriter); ok {
+		qw.upstream = upstream
+	}
+}
@@ -0,0 +1,69 @@
+package resolver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+func TestQueryLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "querylog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	res := New("", records.Config{
+		Domain:     "mesos",
+		TTL:        60,
+		SOARname:   "root.ns1.mesos.",
+		SOAMname:   "ns1.mesos.",
+		RateLimits: map[string]records.RateLimit{"mesos": {Responses: 1}},
+		QueryLog:   records.QueryLog{File: path, Sample: 1},
+	})
+	res.zones[0].publish(&records.RecordGenerator{})
+
+	for _, name := range []string{"leader.mesos.", "leader.mesos.", "example.com."} {
+		res.DNSHandler().ServeDNS(&fakeWriter{}, new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+	if err = res.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 queries in the log instead of %d", len(lines))
+	}
+	var queries []logging.Query
+	for _, line := range lines {
+		var q logging.Query
+		if err = json.Unmarshal([]byte(line), &q); err != nil {
+			t.Fatal(err)
+		}
+		queries = append(queries, q)
+	}
+
+	if q := queries[0]; q.Client != "127.0.0.1" || q.Proto != "udp" || q.Name != "leader.mesos." || q.Type != "A" ||
+		q.Rcode != "NXDOMAIN" || q.Handler != "mesos" || q.Dropped {
+		t.Errorf("unexpected query %+v", q)
+	}
+	if q := queries[1]; !q.Dropped || q.Rcode != "" {
+		t.Errorf("expected the second query to be dropped by RRL instead of %+v", q)
+	}
+	if q := queries[2]; q.Handler != "forward" || q.Rcode != "REFUSED" || q.Upstream != "" {
+		t.Errorf("expected the external query to be refused instead of %+v", q)
+	}
+}
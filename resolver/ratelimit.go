@@ -0,0 +1,198 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+// the most clients or responses whose rate is tracked for a zone
+const rateLimitSize = 100000
+
+// bucket is a token bucket
+type bucket struct {
+	tokens float64
+	last   time.Time
+	over   int // takes over the limit, to slip every n-th one
+}
+
+// limiter keeps a token bucket per key, e.g. per client, refilled with rate
+// tokens per second up to burst
+type limiter struct {
+	rate  float64
+	burst float64
+
+	lock    sync.Mutex
+	buckets map[string]*bucket
+}
+
+// newLimiter returns a limiter, or nil for a rate of 0. the burst defaults
+// to a second worth of tokens.
+func newLimiter(rate float64, burst int) *limiter {
+	if rate <= 0 {
+		return nil
+	}
+	l := &limiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+	if l.burst <= 0 {
+		l.burst = rate
+	}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	return l
+}
+
+// take takes a token from the bucket of key and returns true, or else
+// false along with whether this is a slip-th take over the limit
+func (l *limiter) take(key string, now time.Time, slip int) (bool, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimitSize {
+			l.evict(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, false
+	}
+	b.over++
+	return false, slip > 0 && b.over%slip == 0
+}
+
+// evict drops the buckets which are full again, or else any bucket. the
+// limiter must be locked.
+func (l *limiter) evict(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+	for key := range l.buckets {
+		if len(l.buckets) < rateLimitSize {
+			break
+		}
+		delete(l.buckets, key)
+	}
+}
+
+// zoneLimits are the rate limits of the requests to a zone
+type zoneLimits struct {
+	requests  *limiter // by client IP
+	responses *limiter // by network and response, see rrlKey
+	slip      int
+}
+
+// newZoneLimits returns the limits of a zone, or nil without limits
+func newZoneLimits(rl records.RateLimit) *zoneLimits {
+	zl := &zoneLimits{
+		requests:  newLimiter(rl.Requests, rl.Burst),
+		responses: newLimiter(rl.Responses, 0),
+		slip:      records.DefaultSlip,
+	}
+	if rl.Slip != nil {
+		zl.slip = *rl.Slip
+	}
+	if zl.requests == nil && zl.responses == nil {
+		return nil
+	}
+	return zl
+}
+
+// limit returns a handler which drops the requests of clients over the
+// request rate of the zone, and the UDP responses over its response rate
+// (RRL), and passes the others on to h
+func (res *Resolver) limit(zl *zoneLimits, h func(dns.ResponseWriter, *dns.Msg)) func(dns.ResponseWriter, *dns.Msg) {
+	if zl == nil {
+		return h
+	}
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		ip := addrIP(w.RemoteAddr())
+		if zl.requests != nil {
+			if ok, _ := zl.requests.take(ip.String(), time.Now(), 0); !ok {
+				res.metrics.RateLimited.Inc()
+				return
+			}
+		}
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp && zl.responses != nil {
+			w = &rrlWriter{ResponseWriter: w, res: res, limits: zl, network: rrlNetwork(ip)}
+		}
+		h(w, r)
+	}
+}
+
+// rrlWriter limits the rate of the responses written to a network, the
+// responses over the limit are dropped or slipped, i.e. sent truncated
+type rrlWriter struct {
+	dns.ResponseWriter
+	res     *Resolver
+	limits  *zoneLimits
+	network string
+}
+
+func (w *rrlWriter) WriteMsg(m *dns.Msg) error {
+	ok, slip := w.limits.responses.take(rrlKey(w.network, m), time.Now(), w.limits.slip)
+	switch {
+	case ok:
+		return w.ResponseWriter.WriteMsg(m)
+	case slip:
+		w.res.metrics.RRLSlipped.Inc()
+		tc := *m
+		tc.Truncated = true
+		tc.Answer, tc.Ns, tc.Extra = nil, nil, nil
+		return w.ResponseWriter.WriteMsg(&tc)
+	default:
+		w.res.metrics.RRLDropped.Inc()
+		return nil
+	}
+}
+
+// rrlNetwork returns the /24 IPv4 or /56 IPv6 network of ip, whose
+// responses are limited together
+func rrlNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	if ip != nil {
+		return ip.Mask(net.CIDRMask(56, 128)).String()
+	}
+	return ""
+}
+
+// rrlKey returns the key of the rate of the response m to network:
+// identical answers and empty answers share a rate, and so do the NXDOMAIN
+// answers in the same zone and the errors
+func rrlKey(network string, m *dns.Msg) string {
+	var name, qtype string
+	if len(m.Question) > 0 {
+		name = strings.ToLower(m.Question[0].Name)
+		qtype = dns.TypeToString[m.Question[0].Qtype]
+	}
+	kind := "answer"
+	switch {
+	case m.Rcode == dns.RcodeNameError:
+		kind, qtype = "nxdomain", ""
+		if len(m.Ns) > 0 {
+			name = strings.ToLower(m.Ns[0].Header().Name)
+		}
+	case m.Rcode != dns.RcodeSuccess:
+		kind, name, qtype = "error", "", ""
+	case len(m.Answer) == 0:
+		kind = "nodata"
+	}
+	return network + " " + kind + " " + name + " " + qtype
+}
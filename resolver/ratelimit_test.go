@@ -0,0 +1,108 @@
+package resolver
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+func TestLimiter(t *testing.T) {
+	if newLimiter(0, 10) != nil {
+		t.Error("expected no limiter without a rate")
+	}
+
+	l := newLimiter(1, 2)
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := l.take("a", now, 0); ok != want {
+			t.Errorf("expected take %d to be %v", i, want)
+		}
+	}
+	if ok, _ := l.take("b", now, 0); !ok {
+		t.Error("expected a bucket per key")
+	}
+	if ok, _ := l.take("a", now.Add(time.Second), 0); !ok {
+		t.Error("expected the bucket to refill")
+	}
+
+	// every second take over the limit slips
+	l.take("c", now, 2)
+	l.take("c", now, 2)
+	for i, want := range []bool{false, true, false, true} {
+		if ok, slip := l.take("c", now, 2); ok || slip != want {
+			t.Errorf("expected take %d over the limit to slip: %v", i, want)
+		}
+	}
+}
+
+func TestRRLKey(t *testing.T) {
+	if rrlNetwork(net.ParseIP("10.1.2.3")) != "10.1.2.0" || rrlNetwork(net.ParseIP("2001:db8:1:2::1")) != "2001:db8:1::" {
+		t.Error("unexpected RRL networks")
+	}
+
+	nx := func(name string) *dns.Msg {
+		m := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		m.Rcode = dns.RcodeNameError
+		m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "mesos.", Rrtype: dns.TypeSOA}}}
+		return m
+	}
+	if rrlKey("10.1.2.0", nx("a.mesos.")) != rrlKey("10.1.2.0", nx("b.mesos.")) {
+		t.Error("expected the NXDOMAIN answers of a zone to share a rate")
+	}
+	if rrlKey("10.1.2.0", new(dns.Msg).SetQuestion("a.mesos.", dns.TypeA)) == rrlKey("10.1.2.0", new(dns.Msg).SetQuestion("b.mesos.", dns.TypeA)) {
+		t.Error("expected answers for other names to have rates of their own")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	config := records.Config{
+		Domain:   "mesos",
+		TTL:      60,
+		SOARname: "root.ns1.mesos.",
+		SOAMname: "ns1.mesos.",
+		RateLimits: map[string]records.RateLimit{
+			"mesos": {Responses: 1},
+			".":     {Requests: 2},
+		},
+	}
+	res := New("", config)
+	res.zones[0].publish(&records.RecordGenerator{})
+	count := func(c logging.Counter) string { return c.(*logging.LogCounter).String() }
+
+	// the same answer over UDP: answered, dropped, then slipped
+	var msgs []*dns.Msg
+	for i := 0; i < 3; i++ {
+		w := &fakeWriter{}
+		res.DNSHandler().ServeDNS(w, new(dns.Msg).SetQuestion("leader.mesos.", dns.TypeA))
+		msgs = append(msgs, w.msg)
+	}
+	if msgs[0] == nil || msgs[0].Truncated || len(msgs[0].Ns) == 0 {
+		t.Errorf("expected the first answer instead of %v", msgs[0])
+	}
+	if msgs[1] != nil {
+		t.Errorf("expected the second answer to be dropped instead of %v", msgs[1])
+	}
+	if msgs[2] == nil || !msgs[2].Truncated || len(msgs[2].Ns) != 0 {
+		t.Errorf("expected the third answer to be truncated instead of %v", msgs[2])
+	}
+	if count(res.Metrics().RRLDropped) != "1" || count(res.Metrics().RRLSlipped) != "1" {
+		t.Errorf("unexpected RRL counters %+v", *res.Metrics())
+	}
+
+	// two external requests per second, refused without ExternalOn
+	var answered int
+	for i := 0; i < 3; i++ {
+		w := &fakeWriter{}
+		res.DNSHandler().ServeDNS(w, new(dns.Msg).SetQuestion("example.com.", dns.TypeA))
+		if w.msg != nil {
+			answered++
+		}
+	}
+	if answered != 2 || count(res.Metrics().RateLimited) != "1" {
+		t.Errorf("expected 2 requests answered instead of %d, %+v", answered, *res.Metrics())
+	}
+}
@@ -3,23 +3,20 @@
 package resolver
 
 import (
-	"encoding/binary"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/emicklei/go-restful"
-	"github.com/mesos/mesos-go/detector"
-	_ "github.com/mesos/mesos-go/detector/zoo"
-	mesos "github.com/mesos/mesos-go/mesosproto"
 	"github.com/mesosphere/mesos-dns/logging"
 	"github.com/mesosphere/mesos-dns/records"
 	"github.com/mesosphere/mesos-dns/util"
@@ -32,116 +29,407 @@ var (
 
 // holds configuration state and the resource records
 type Resolver struct {
-	version    string
-	config     records.Config
-	rs         *records.RecordGenerator
-	rsLock     sync.RWMutex
-	leader     string
-	leaderLock sync.RWMutex
+	version string
+	config  records.Config
+	zones   []*zone // the cluster of config.Domain first, then the others
+	stubs   []*stubZone
+	acls    acls
+	limits  map[string]*zoneLimits // by domain, "." for forwarded requests
+
+	// done once the resolver is stopped, see Stop
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// the handlers of DNS and HTTP requests, and the counters they update.
+	// the DNS handlers are keyed by whether they forward external requests.
+	dnsMuxes  map[bool]*dns.ServeMux
+	container *restful.Container
+	metrics   *logging.LogOut
+	queryLog  *logging.QueryLog // nil unless QueryLog is configured
+
+	// listeners to serve instead of binding the configured addresses
+	packetConns   []net.PacketConn
+	listeners     []net.Listener
+	httpListeners []net.Listener
+
+	serversLock sync.Mutex
+	dnsServers  []*dnsServer
+	httpServer  *http.Server
 }
 
-func New(version string, config records.Config) *Resolver {
-	return &Resolver{
+// Option configures a Resolver, see New
+type Option func(*Resolver)
+
+// WithPacketConn makes the resolver serve DNS over UDP on pc, instead of
+// the configured addresses, forwarding external requests if ExternalOn is
+// set. pc must be a *net.UDPConn. it may be given several times.
+func WithPacketConn(pc net.PacketConn) Option {
+	return func(res *Resolver) {
+		res.packetConns = append(res.packetConns, pc)
+	}
+}
+
+// WithListener makes the resolver serve DNS over TCP on l, instead of the
+// configured addresses, forwarding external requests if ExternalOn is set.
+// l must be a *net.TCPListener. it may be given several times.
+func WithListener(l net.Listener) Option {
+	return func(res *Resolver) {
+		res.listeners = append(res.listeners, l)
+	}
+}
+
+// WithHTTPListener makes the resolver serve HTTP on l, instead of the
+// configured addresses. it may be given several times.
+func WithHTTPListener(l net.Listener) Option {
+	return func(res *Resolver) {
+		res.httpListeners = append(res.httpListeners, l)
+	}
+}
+
+// dnsServer is a DNS server started by Serve, done is closed once it
+// stopped serving
+type dnsServer struct {
+	*dns.Server
+	done chan struct{}
+}
+
+// New returns a resolver for config. it has its own handlers and
+// counters, so that several resolvers can run in the same process.
+func New(version string, config records.Config, opts ...Option) *Resolver {
+	res := &Resolver{
 		version: version,
 		config:  config,
-		rs:      &records.RecordGenerator{},
+		acls:    newACLs(config.ACLs),
+		metrics: logging.NewLogOut(),
+	}
+	for _, opt := range opts {
+		opt(res)
+	}
+	res.ctx, res.cancel = context.WithCancel(context.Background())
+	if ql := config.QueryLog; ql.File != "" {
+		var err error
+		res.queryLog, err = logging.NewQueryLog(ql.File, int64(ql.MaxSize)<<20, ql.MaxBackups, ql.Sample)
+		if err != nil {
+			logging.Error.Println("query log not opened: " + err.Error())
+		}
 	}
+	for _, c := range config.ClusterConfigs() {
+		res.zones = append(res.zones, newZone(c, res.metrics))
+	}
+
+	domains := make([]string, 0, len(config.StubZones))
+	for domain := range config.StubZones {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		res.stubs = append(res.stubs, newStubZone(domain, config.StubZones[domain], res.timeout()))
+	}
+
+	res.limits = make(map[string]*zoneLimits, len(config.RateLimits))
+	for zone, rl := range config.RateLimits {
+		res.limits[zone] = newZoneLimits(rl)
+	}
+	res.dnsMuxes = map[bool]*dns.ServeMux{
+		true:  res.newDNSMux(true),
+		false: res.newDNSMux(false),
+	}
+	res.container = res.newContainer()
+	return res
 }
 
-// return the current (read-only) record set. attempts to write to the returned
-// object will likely result in a data race.
-func (res *Resolver) records() *records.RecordGenerator {
-	res.rsLock.RLock()
-	defer res.rsLock.RUnlock()
-	return res.rs
+// DNSHandler returns the handler of the DNS queries, e.g. to serve them
+// with a dns.Server of its own. it forwards external requests if
+// ExternalOn is set.
+func (res *Resolver) DNSHandler() dns.Handler {
+	return res.dnsMuxes[res.config.ExternalOn]
 }
 
-// launches DNS server for a resolver, returns immediately
-func (res *Resolver) LaunchDNS() <-chan error {
-	// Handers for Mesos requests
-	dns.HandleFunc(res.config.Domain+".", panicRecover(res.HandleMesos))
+// HTTPHandler returns the handler of the HTTP API, e.g. to serve it with
+// an http.Server of its own
+func (res *Resolver) HTTPHandler() http.Handler {
+	return res.container
+}
+
+// Metrics returns the counters of the resolver
+func (res *Resolver) Metrics() *logging.LogOut {
+	return res.metrics
+}
+
+// timeout returns the timeout of outbound queries
+func (res *Resolver) timeout() time.Duration {
+	if res.config.Timeout != 0 {
+		return time.Duration(res.config.Timeout) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// zoneOf returns the zone of the cluster with the longest domain that name
+// is in, or nil if there is none
+func (res *Resolver) zoneOf(name string) *zone {
+	var found *zone
+	for _, z := range res.zones {
+		if (name == z.apex || strings.HasSuffix(name, "."+z.apex)) && (found == nil || len(z.apex) > len(found.apex)) {
+			found = z
+		}
+	}
+	return found
+}
+
+// newDNSMux returns the handlers of the DNS queries, which refuse external
+// requests unless external is set
+func (res *Resolver) newDNSMux(external bool) *dns.ServeMux {
+	mux := dns.NewServeMux()
+	// Handers for Mesos requests, of every cluster
+	for _, z := range res.zones {
+		mux.HandleFunc(z.apex, res.logQuery("mesos", panicRecover(res.limit(res.limits[z.config.Domain],
+			res.restrict(res.acls.allowsZone, res.HandleMesos)))))
+	}
+	// Handlers for the domains of peer clusters
+	for _, s := range res.stubs {
+		mux.HandleFunc(s.apex, res.logQuery("stub", panicRecover(res.limit(res.limits[strings.TrimSuffix(s.apex, ".")],
+			res.restrict(res.acls.allowsZone, res.HandleStub)))))
+	}
 	// Handler for nonMesos requests
-	dns.HandleFunc(".", panicRecover(res.HandleNonMesos))
+	mux.HandleFunc(".", res.logQuery("forward", panicRecover(res.limit(res.limits["."],
+		res.restrict(res.acls.allowsRecursion, func(w dns.ResponseWriter, r *dns.Msg) {
+			res.handleNonMesos(w, r, external)
+		})))))
+	return mux
+}
+
+// dnsListeners returns the addresses to serve DNS on, Listener and Port
+// unless DNSListeners are configured
+func (res *Resolver) dnsListeners() []records.ListenAddr {
+	if len(res.config.DNSListeners) > 0 {
+		return res.config.DNSListeners
+	}
+	external := res.config.ExternalOn
+	return []records.ListenAddr{{
+		Addr:       net.JoinHostPort(res.config.Listener, strconv.Itoa(res.config.Port)),
+		ExternalOn: &external,
+	}}
+}
 
-	errCh := make(chan error, 2)
-	go func() { errCh <- res.Serve("tcp") }()
-	go func() { errCh <- res.Serve("udp") }()
+// httpAddrs returns the addresses to serve HTTP on, Listener and
+// HttpPort unless HTTPListeners are configured
+func (res *Resolver) httpAddrs() []string {
+	if len(res.config.HTTPListeners) > 0 {
+		return res.config.HTTPListeners
+	}
+	return []string{net.JoinHostPort(res.config.Listener, strconv.Itoa(res.config.HttpPort))}
+}
+
+// launches DNS server for a resolver, returns immediately. it serves the
+// listeners given as options, or else the configured addresses over both
+// tcp and udp.
+func (res *Resolver) LaunchDNS() <-chan error {
+	if len(res.packetConns) == 0 && len(res.listeners) == 0 {
+		listeners := res.dnsListeners()
+		errCh := make(chan error, 2*len(listeners))
+		for _, l := range listeners {
+			addr, external := l.Addr, *l.ExternalOn
+			go func() { errCh <- res.serve("tcp", addr, external) }()
+			go func() { errCh <- res.serve("udp", addr, external) }()
+		}
+		return errCh
+	}
+
+	errCh := make(chan error, len(res.packetConns)+len(res.listeners))
+	for _, pc := range res.packetConns {
+		server := &dns.Server{PacketConn: pc, Net: "udp"}
+		go func() { errCh <- res.serveDNS(server, res.config.ExternalOn) }()
+	}
+	for _, l := range res.listeners {
+		server := &dns.Server{Listener: l, Net: "tcp"}
+		go func() { errCh <- res.serveDNS(server, res.config.ExternalOn) }()
+	}
 	return errCh
 }
 
-// starts a DNS server for net protocol (tcp/udp), blocks until service has stopped
-func (res *Resolver) Serve(net string) error {
-	defer util.HandleCrash()
+// Serve starts a DNS server for the net protocol proto (tcp/udp) on every
+// configured address, see LaunchDNS. blocks until service has stopped, see
+// Stop, or until one of the servers fails.
+func (res *Resolver) Serve(proto string) error {
+	listeners := res.dnsListeners()
+	errCh := make(chan error, len(listeners))
+	for _, l := range listeners {
+		addr, external := l.Addr, *l.ExternalOn
+		go func() { errCh <- res.serve(proto, addr, external) }()
+	}
+	for range listeners {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// starts a DNS server for the net protocol proto (tcp/udp) on addr, which
+// forwards external requests if external is set. blocks until service has
+// stopped, see Stop
+func (res *Resolver) serve(proto string, addr string, external bool) error {
+	if res.ctx.Err() != nil {
+		return nil
+	}
 
 	server := &dns.Server{
-		Addr:       res.config.Listener + ":" + strconv.Itoa(res.config.Port),
-		Net:        net,
+		Net:        proto,
 		TsigSecret: nil,
 	}
+	var err error
+	if proto == "udp" {
+		server.PacketConn, err = net.ListenPacket(proto, addr)
+	} else {
+		server.Listener, err = net.Listen(proto, addr)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to setup %q server on %s: %v", proto, addr, err)
+	}
+	return res.serveDNS(server, external)
+}
 
-	err := server.ListenAndServe()
+// serveDNS serves the queries on the bound listener of server, forwarding
+// external requests if external is set. blocks until service has stopped
+func (res *Resolver) serveDNS(s *dns.Server, external bool) error {
+	defer util.HandleCrash()
+
+	s.Handler = res.dnsMuxes[external]
+	server := &dnsServer{Server: s, done: make(chan struct{})}
+	defer close(server.done)
+
+	res.serversLock.Lock()
+	if res.ctx.Err() != nil {
+		res.serversLock.Unlock()
+		if s.PacketConn != nil {
+			s.PacketConn.Close()
+		}
+		if s.Listener != nil {
+			s.Listener.Close()
+		}
+		return nil
+	}
+	res.dnsServers = append(res.dnsServers, server)
+	res.serversLock.Unlock()
+
+	err := server.ActivateAndServe()
 	if err != nil {
-		return fmt.Errorf("Failed to setup %q server: %v", net, err)
+		return fmt.Errorf("Failed to setup %q server: %v", s.Net, err)
+	} else if res.ctx.Err() != nil {
+		logging.Verbose.Printf("Not listening/serving any more requests.")
 	} else {
 		logging.Error.Printf("Not listening/serving any more requests.")
 	}
 	return nil
 }
 
-// launches Zookeeper detector, returns immediately two chans: the first fires an empty
-// struct whenever there's a new mesos leader, the second if there's an unrecoverable
-// error in the master detector.
-func (res *Resolver) LaunchZK(initialDetectionTimeout time.Duration) (<-chan struct{}, <-chan error) {
-	errCh := make(chan error, 1)
-	leaderCh := make(chan struct{}, 1)
-	listenerFunc := func(newLeader bool) {
-		if newLeader {
-			// don't block if the buffer is full
-			select {
-			case leaderCh <- struct{}{}:
-			default:
-			}
+// stop shuts the server down, once it finished the queries in progress,
+// and waits until it stopped serving. the serve loop only notices the
+// shutdown with the next query: Shutdown sends one, but if the loop gets
+// it before the shutdown is signaled, Shutdown gives up waiting and one
+// more query is needed.
+func (server *dnsServer) stop() error {
+	err := server.Shutdown()
+	if err != nil && err.Error() == "dns: server shutdown is pending" {
+		var addr net.Addr
+		if server.PacketConn != nil {
+			addr = server.PacketConn.LocalAddr()
+		} else {
+			addr = server.Listener.Addr()
 		}
+		c := &dns.Client{Net: server.Net}
+		go c.Exchange(new(dns.Msg), addr.String())
+		err = nil
 	}
+	if err != nil {
+		return fmt.Errorf("Failed to stop %q server: %v", server.Net, err)
+	}
+	<-server.done
+	return nil
+}
 
-	go func() {
-		defer util.HandleCrash()
+// launches the refresh of the records of every cluster, returns
+// immediately a chan that fires if there's an unrecoverable error in the
+// master detector of a cluster. the records of each cluster are reloaded
+// every RefreshSeconds and whenever Zookeeper reports a new leader, and
+// updated from the event stream of the leader if StateStream is set.
+// the refresh ends when the resolver is stopped.
+func (res *Resolver) LaunchRefresh(zkInitialDetectionTimeout time.Duration) <-chan error {
+	errCh := make(chan error, len(res.zones))
+	for _, z := range res.zones {
+		z.launchRefresh(res.ctx, zkInitialDetectionTimeout, errCh)
+	}
+	return errCh
+}
 
-		startedCh, err := res.ZKdetect(listenerFunc)
-		if err != nil {
-			errCh <- err
-			return
+// Stop stops the resolver gracefully: the DNS and HTTP servers stop
+// accepting new requests and finish the ones in progress, the refresh of
+// the records ends along with the Zookeeper detectors, the counters are
+// logged and the query log is closed. it returns once all of this is
+// done, or with the error of ctx if ctx is done first. the resolver can't
+// be launched again.
+func (res *Resolver) Stop(ctx context.Context) error {
+	res.cancel()
+	if res.queryLog != nil {
+		defer func() {
+			if err := res.queryLog.Close(); err != nil {
+				logging.Error.Println(err)
+			}
+		}()
+	}
+
+	res.serversLock.Lock()
+	servers := res.dnsServers
+	httpServer := res.httpServer
+	res.serversLock.Unlock()
+
+	errCh := make(chan error, len(servers)+1)
+	for _, server := range servers {
+		go func(server *dnsServer) {
+			errCh <- server.stop()
+		}(server)
+	}
+	pending := len(servers)
+	if httpServer != nil {
+		go func() { errCh <- httpServer.Shutdown(ctx) }()
+		pending++
+	}
+
+	refreshed := make(chan struct{})
+	go func() {
+		for _, z := range res.zones {
+			z.running.Wait()
 		}
+		close(refreshed)
+	}()
 
-		logging.VeryVerbose.Println("Warning: waiting for initial information from Zookeper.")
+	var errs []string
+	for pending > 0 || refreshed != nil {
 		select {
-		case <-startedCh:
-			logging.VeryVerbose.Println("Warning: got initial information from Zookeper.")
-		case <-time.After(initialDetectionTimeout):
-			errCh <- fmt.Errorf("timed out waiting for initial ZK detection, exiting")
+		case err := <-errCh:
+			pending--
+			if err != nil {
+				errs = append(errs, err.Error())
+			}
+		case <-refreshed:
+			refreshed = nil
+		case <-ctx.Done():
+			res.metrics.Flush()
+			return ctx.Err()
 		}
-	}()
-	return leaderCh, errCh
+	}
+
+	res.metrics.Flush()
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-// triggers a new refresh from mesos master
+// triggers a new refresh of the records of every cluster from its masters
 func (res *Resolver) Reload() {
-	t := records.RecordGenerator{}
-	// Being very conservative
-	res.leaderLock.RLock()
-	currentLeader := res.leader
-	res.leaderLock.RUnlock()
-	err := t.ParseState(currentLeader, res.config)
-
-	if err == nil {
-		timestamp := uint32(time.Now().Unix())
-		// may need to refactor for fairness
-		res.rsLock.Lock()
-		defer res.rsLock.Unlock()
-		res.config.SOASerial = timestamp
-		res.rs = &t
-	} else {
-		logging.VeryVerbose.Println("Warning: master not found; keeping old DNS state")
+	for _, z := range res.zones {
+		z.reload()
 	}
 }
 
@@ -153,11 +441,7 @@ func (res *Resolver) resolveOut(r *dns.Msg, nameserver string, proto string, cnt
 	c := new(dns.Client)
 	c.Net = proto
 
-	var t time.Duration = 5 * 1e9
-	if res.config.Timeout != 0 {
-		t = time.Duration(int64(res.config.Timeout * 1e9))
-	}
-
+	t := res.timeout()
 	c.DialTimeout = t
 	c.ReadTimeout = t
 	c.WriteTimeout = t
@@ -171,7 +455,7 @@ func (res *Resolver) resolveOut(r *dns.Msg, nameserver string, proto string, cnt
 	if (in != nil) && (len(in.Answer) == 0) && (!in.MsgHdr.Authoritative) && (len(in.Ns) > 0) && (err != nil) {
 
 		if cnt == recurseCnt {
-			logging.CurLog.NonMesosRecursed.Inc()
+			res.metrics.NonMesosRecursed.Inc()
 		}
 
 		if cnt > 0 {
@@ -185,52 +469,8 @@ func (res *Resolver) resolveOut(r *dns.Msg, nameserver string, proto string, cnt
 	return in, err
 }
 
-// formatSRV returns the SRV resource record for target
-func (res *Resolver) formatSRV(name string, target string) (*dns.SRV, error) {
-	ttl := uint32(res.config.TTL)
-
-	h, port, err := net.SplitHostPort(target)
-	if err != nil {
-		return nil, errors.New("invalid target")
-	}
-	p, _ := strconv.Atoi(port)
-
-	return &dns.SRV{
-		Hdr: dns.RR_Header{
-			Name:   name,
-			Rrtype: dns.TypeSRV,
-			Class:  dns.ClassINET,
-			Ttl:    ttl,
-		},
-		Priority: 0,
-		Weight:   0,
-		Port:     uint16(p),
-		Target:   h,
-	}, nil
-}
-
-// returns the A resource record for target
-// assumes target is a well formed IPv4 address
-func (res *Resolver) formatA(dom string, target string) (*dns.A, error) {
-	ttl := uint32(res.config.TTL)
-
-	a := net.ParseIP(target)
-	if a == nil {
-		return nil, errors.New("invalid target")
-	}
-
-	return &dns.A{
-		Hdr: dns.RR_Header{
-			Name:   dom,
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    ttl},
-		A: a.To4(),
-	}, nil
-}
-
 // formatSOA returns the SOA resource record for the mesos domain
-func (res *Resolver) formatSOA(dom string) (*dns.SOA, error) {
+func (res *Resolver) formatSOA(dom string, serial uint32) (*dns.SOA, error) {
 	ttl := uint32(res.config.TTL)
 
 	return &dns.SOA{
@@ -242,11 +482,11 @@ func (res *Resolver) formatSOA(dom string) (*dns.SOA, error) {
 		},
 		Ns:      res.config.SOARname,
 		Mbox:    res.config.SOAMname,
-		Serial:  res.config.SOASerial,
+		Serial:  serial,
 		Refresh: res.config.SOARefresh,
 		Retry:   res.config.SOARetry,
 		Expire:  res.config.SOAExpire,
-		Minttl:  ttl,
+		Minttl:  res.config.SOAMinttl,
 	}, nil
 }
 
@@ -265,29 +505,22 @@ func (res *Resolver) formatNS(dom string) (*dns.NS, error) {
 	}, nil
 }
 
-// reorders answers for very basic load balancing
-func shuffleAnswers(answers []dns.RR) []dns.RR {
-	rand.Seed(time.Now().UTC().UnixNano())
-
-	n := len(answers)
-	for i := 0; i < n; i++ {
-		r := i + rand.Intn(n-i)
-		answers[r], answers[i] = answers[i], answers[r]
-	}
-
-	return answers
-}
-
 // makes non-mesos queries to external nameserver
 func (res *Resolver) HandleNonMesos(w dns.ResponseWriter, r *dns.Msg) {
+	res.handleNonMesos(w, r, res.config.ExternalOn)
+}
+
+// handleNonMesos forwards the request if external is set, or else
+// refuses it
+func (res *Resolver) handleNonMesos(w dns.ResponseWriter, r *dns.Msg, external bool) {
 	var err error
 	var m *dns.Msg
 
 	// tracing info
-	logging.CurLog.NonMesosRequests.Inc()
+	res.metrics.NonMesosRequests.Inc()
 
 	// If external request are disabled
-	if !res.config.ExternalOn {
+	if !external {
 		m = new(dns.Msg)
 		// set refused
 		m.SetRcode(r, 5)
@@ -302,6 +535,7 @@ func (res *Resolver) HandleNonMesos(w dns.ResponseWriter, r *dns.Msg) {
 			nameserver := resolver + ":53"
 			m, err = res.resolveOut(r, nameserver, proto, recurseCnt)
 			if err == nil {
+				setUpstream(w, nameserver)
 				break
 			}
 		}
@@ -316,13 +550,13 @@ func (res *Resolver) HandleNonMesos(w dns.ResponseWriter, r *dns.Msg) {
 	if err != nil {
 		logging.Error.Println(r.Question[0].Name)
 		logging.Error.Println(err)
-		logging.CurLog.NonMesosFailed.Inc()
+		res.metrics.NonMesosFailed.Inc()
 	} else {
 		// nxdomain
 		if len(m.Answer) == 0 {
-			logging.CurLog.NonMesosNXDomain.Inc()
+			res.metrics.NonMesosNXDomain.Inc()
 		} else {
-			logging.CurLog.NonMesosSuccess.Inc()
+			res.metrics.NonMesosSuccess.Inc()
 		}
 	}
 
@@ -334,11 +568,23 @@ func (res *Resolver) HandleNonMesos(w dns.ResponseWriter, r *dns.Msg) {
 
 // HandleMesos is a resolver request handler that responds to a resource
 // question with resource answer(s)
-// it can handle {A, SRV, ANY}
+// it can handle {A, SRV, TXT, CNAME, SOA, NS, ANY}, and any other type of
+// static records, e.g. MX or AAAA
+// questions with wildcards get the records of all the matching names, see
+// records.RecordGenerator.Match
+// questions for aliases get the chain of CNAME records within the domain
+// followed by the records of its end, a loop gets a SERVFAIL answer
+// names without records of the requested type get an empty NOERROR
+// (NODATA) answer, names without any records get a NXDOMAIN answer, both
+// with the SOA record of the domain in the authority section (RFC 2308)
+// questions for a cluster whose records couldn't be loaded, or are stale for
+// longer than MaxStaleness, get a SERVFAIL answer. the TTL of stale answers
+// is at most StaleTTL. zone transfers aren't supported, the clients that the
+// transfer ACL allows get a NOTIMP answer.
 func (res *Resolver) HandleMesos(w dns.ResponseWriter, r *dns.Msg) {
 	var err error
 
-	dom := strings.ToLower(cleanWild(r.Question[0].Name))
+	dom := strings.ToLower(r.Question[0].Name)
 	qType := r.Question[0].Qtype
 
 	m := new(dns.Msg)
@@ -346,99 +592,147 @@ func (res *Resolver) HandleMesos(w dns.ResponseWriter, r *dns.Msg) {
 	m.RecursionAvailable = res.config.RecurseOn
 	m.SetReply(r)
 
-	rs := res.records()
+	if qType == dns.TypeAXFR || qType == dns.TypeIXFR {
+		m.SetRcode(r, dns.RcodeNotImplemented)
+		res.metrics.MesosRequests.Inc()
+		if err = w.WriteMsg(m); err != nil {
+			logging.Error.Println(err)
+		}
+		return
+	}
+
+	now := time.Now()
+	z := res.zoneOf(dom)
+	if z == nil || !z.serving(now) {
+		m.SetRcode(r, dns.RcodeServerFailure)
+		res.metrics.MesosRequests.Inc()
+		res.metrics.MesosFailed.Inc()
+		if err = w.WriteMsg(m); err != nil {
+			logging.Error.Println(err)
+		}
+		return
+	}
+	apex := z.apex
+
+	snap := z.snapshot()
+	rs := snap.rs
+	names := rs.Match(dom, z.config.Domain)
+
+	// CNAME requests, other types chase the CNAME records of a single name
+	var chain []dns.RR
+	if (qType == dns.TypeCNAME) || (qType == dns.TypeANY) {
+		for _, rr := range uniqueRRs(rs, names, dns.TypeCNAME) {
+			m.Answer = append(m.Answer, answer(rr, dom))
+		}
+	} else if len(names) == 1 && names[0] == dom {
+		var target string
+		chain, target, err = chase(rs, dom, apex)
+		if target != dom {
+			dom, names = target, nil
+			if rs.Exists(target) {
+				names = []string{target}
+			}
+		}
+	}
 
 	// SRV requests
 	if (qType == dns.TypeSRV) || (qType == dns.TypeANY) {
-		for _, srv := range rs.SRVs[dom] {
-			rr, err := res.formatSRV(r.Question[0].Name, srv)
-			if err != nil {
-				logging.Error.Println(err)
-			} else {
-				m.Answer = append(m.Answer, rr)
-				// return one corresponding A record add additional info
-				host := strings.Split(srv, ":")[0]
-				if len(rs.As[host]) != 0 {
-					rr, err := res.formatA(host, rs.As[host][0])
-					if err != nil {
-						logging.Error.Println(err)
-					} else {
-						m.Extra = append(m.Extra, rr)
-					}
-				}
-
+		for _, rr := range uniqueRRs(rs, names, dns.TypeSRV) {
+			m.Answer = append(m.Answer, answer(rr, dom))
+			// return one corresponding A record add additional info
+			if a := rs.Lookup(rr.(*dns.SRV).Target, dns.TypeA); len(a) != 0 {
+				m.Extra = append(m.Extra, a[0].RR)
 			}
 		}
 	}
 
 	// A requests
 	if (qType == dns.TypeA) || (qType == dns.TypeANY) {
-		for _, a := range rs.As[dom] {
-			rr, err := res.formatA(dom, a)
-			if err != nil {
-				logging.Error.Println(err)
-			} else {
-				m.Answer = append(m.Answer, rr)
-			}
+		for _, rr := range uniqueRRs(rs, names, dns.TypeA) {
+			m.Answer = append(m.Answer, answer(rr, dom))
+		}
+	}
+
+	// TXT requests
+	if (qType == dns.TypeTXT) || (qType == dns.TypeANY) {
+		for _, rr := range uniqueRRs(rs, names, dns.TypeTXT) {
+			m.Answer = append(m.Answer, answer(rr, dom))
+		}
+	}
 
+	// requests of other types, e.g. MX or AAAA static records
+	if qType == dns.TypeANY {
+		for _, t := range otherTypes(rs, names) {
+			for _, rr := range uniqueRRs(rs, names, t) {
+				m.Answer = append(m.Answer, answer(rr, dom))
+			}
+		}
+	} else if !mesosTypes[qType] && !(dom == apex && (qType == dns.TypeSOA || qType == dns.TypeNS)) {
+		for _, rr := range uniqueRRs(rs, names, qType) {
+			m.Answer = append(m.Answer, answer(rr, dom))
 		}
 	}
 
-	// SOA requests
-	if (qType == dns.TypeSOA) || (qType == dns.TypeANY) {
-		rr, err := res.formatSOA(r.Question[0].Name)
+	// SOA requests, only the domain itself has a SOA record
+	if dom == apex && ((qType == dns.TypeSOA) || (qType == dns.TypeANY)) {
+		rr, err := res.formatSOA(apex, snap.serial)
 		if err != nil {
 			logging.Error.Println(err)
 		} else {
-			m.Ns = append(m.Ns, rr)
+			m.Answer = append(m.Answer, rr)
 		}
 	}
 
-	// NS requests
-	if (qType == dns.TypeNS) || (qType == dns.TypeANY) {
-		rr, err := res.formatNS(r.Question[0].Name)
-		logging.Error.Println("NS request")
+	// NS requests, only the domain itself has a NS record
+	if dom == apex && ((qType == dns.TypeNS) || (qType == dns.TypeANY)) {
+		rr, err := res.formatNS(apex)
 		if err != nil {
 			logging.Error.Println(err)
 		} else {
-			m.Ns = append(m.Ns, rr)
+			m.Answer = append(m.Answer, rr)
 		}
 	}
 
-	// shuffle answers
-	m.Answer = shuffleAnswers(m.Answer)
+	// reorder answers
+	m.Answer = snap.order(dom, m.Answer)
 	// tracing info
-	logging.CurLog.MesosRequests.Inc()
+	res.metrics.MesosRequests.Inc()
 
 	if err != nil {
-		logging.CurLog.MesosFailed.Inc()
-	} else if (qType == dns.TypeAAAA) && (len(rs.SRVs[dom]) > 0 || len(rs.As[dom]) > 0) {
-		// correct handling of AAAA if there are A or SRV records
-		m.Authoritative = true
-		// set NOERROR
-		m.SetRcode(r, 0)
-		// leave answer empty (NOERROR --> NODATA)
-
+		logging.Error.Println(err)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		m.Answer = nil
+		res.metrics.MesosFailed.Inc()
+	} else if len(m.Answer) > 0 || !inDomain(dom, apex) {
+		// the chain of an alias outside of the domain ends with its target
+		res.metrics.MesosSuccess.Inc()
 	} else {
-		// no answers but not a {SOA,SRV} request
-		if len(m.Answer) == 0 && (qType != dns.TypeSOA) && (qType != dns.TypeNS) && (qType != dns.TypeSRV) {
-			// set NXDOMAIN
-			m.SetRcode(r, 3)
-
-			rr, err := res.formatSOA(r.Question[0].Name)
-			if err != nil {
-				logging.Error.Println(err)
-			} else {
-				m.Ns = append(m.Ns, rr)
-			}
-
-			logging.CurLog.MesosNXDomain.Inc()
-			logging.VeryVerbose.Println("total A rrs:\t" + strconv.Itoa(len(rs.As)))
+		// negative answer: NODATA if the name exists, NXDOMAIN otherwise
+		if len(names) > 0 {
+			res.metrics.MesosSuccess.Inc()
+		} else {
+			m.SetRcode(r, dns.RcodeNameError)
+			res.metrics.MesosNXDomain.Inc()
+			logging.VeryVerbose.Println("total names:\t" + strconv.Itoa(len(rs.Records)))
 			logging.VeryVerbose.Println("failed looking for " + r.Question[0].String())
+		}
+
+		rr, err := res.formatSOA(apex, snap.serial)
+		if err != nil {
+			logging.Error.Println(err)
 		} else {
-			logging.CurLog.MesosSuccess.Inc()
+			m.Ns = append(m.Ns, rr)
 		}
 	}
+	if err == nil {
+		m.Answer = append(chain, m.Answer...)
+	}
+	if ttl := uint32(z.config.StaleTTL); ttl > 0 && z.staleness(now) > 0 {
+		capTTL(m.Answer, ttl)
+		capTTL(m.Ns, ttl)
+		capTTL(m.Extra, ttl)
+	}
+	truncate(w, r, m)
 
 	err = w.WriteMsg(m)
 	if err != nil {
@@ -446,32 +740,108 @@ func (res *Resolver) HandleMesos(w dns.ResponseWriter, r *dns.Msg) {
 	}
 }
 
-// starts an http server for mesos-dns queries, returns immediately
-func (res *Resolver) LaunchHTTP() <-chan error {
-	defer util.HandleCrash()
+// maxChase is the longest chain of CNAME records chased in an answer
+const maxChase = 8
+
+// chase follows the CNAME records from name within the domain. It returns
+// the records of the chain and the name it ends at, which has no CNAME
+// record or is outside of the domain. It fails on loops and on chains
+// longer than maxChase.
+func chase(rs *records.RecordGenerator, name string, apex string) ([]dns.RR, string, error) {
+	var chain []dns.RR
+	seen := map[string]bool{name: true}
+	for inDomain(name, apex) {
+		cnames := rs.Lookup(name, dns.TypeCNAME)
+		if len(cnames) == 0 {
+			break
+		}
+		if len(chain) == maxChase {
+			return nil, name, errors.New("CNAME chain longer than " + strconv.Itoa(maxChase) + " at " + name)
+		}
+		rr := cnames[0].RR
+		chain = append(chain, rr)
+		name = rr.(*dns.CNAME).Target
+		if seen[name] {
+			return nil, name, errors.New("CNAME loop at " + name)
+		}
+		seen[name] = true
+	}
+	return chain, name, nil
+}
+
+// inDomain returns true if name is the domain apex or one of its subdomains
+func inDomain(name string, apex string) bool {
+	return name == apex || strings.HasSuffix(name, "."+apex)
+}
 
-	// webserver + available routes
+// newContainer returns the routes of the HTTP API
+func (res *Resolver) newContainer() *restful.Container {
+	// webserver + available routes, each restricted by its acl
 	ws := new(restful.WebService)
-	ws.Route(ws.GET("/v1/version").To(res.RestVersion))
-	ws.Route(ws.GET("/v1/config").To(res.RestConfig))
-	ws.Route(ws.GET("/v1/hosts/{host}").To(res.RestHost))
-	ws.Route(ws.GET("/v1/hosts/{host}/ports").To(res.RestPorts))
-	ws.Route(ws.GET("/v1/services/{service}").To(res.RestService))
-	restful.Add(ws)
+	route := func(path string, f restful.RouteFunction) {
+		ws.Route(ws.GET(path).Filter(res.restrictHTTP(path)).To(f))
+	}
+	route("/v1/version", res.RestVersion)
+	route("/health", res.RestHealth)
+	route("/v1/config", res.RestConfig)
+	route("/v1/status", res.RestStatus)
+	route("/v1/clusters", res.RestClusters)
+	route("/v1/stubzones", res.RestStubZones)
+	route("/v1/hosts/{host}", res.RestHost)
+	route("/v1/hosts/{host}/ports", res.RestPorts)
+	route("/v1/services/{service}", res.RestService)
+
+	container := restful.NewContainer()
+	container.Add(ws)
+	return container
+}
+
+// starts an http server for mesos-dns queries, returns immediately. it
+// serves the listeners given as options, or else the configured addresses.
+func (res *Resolver) LaunchHTTP() <-chan error {
+	defer util.HandleCrash()
 
-	portString := ":" + strconv.Itoa(res.config.HttpPort)
+	server := &http.Server{Handler: res.container}
 
-	errCh := make(chan error, 1)
-	go func() {
-		var err error
-		defer func() { errCh <- err }()
+	res.serversLock.Lock()
+	res.httpServer = server
+	res.serversLock.Unlock()
 
-		if err = http.ListenAndServe(portString, nil); err != nil {
-			err = fmt.Errorf("Failed to setup http server: %v", err)
-		} else {
-			logging.Error.Println("Not serving http requests any more.")
+	listen := make([]func() (net.Listener, error), 0, len(res.httpListeners))
+	for _, l := range res.httpListeners {
+		l := l
+		listen = append(listen, func() (net.Listener, error) { return l, nil })
+	}
+	if len(listen) == 0 {
+		for _, addr := range res.httpAddrs() {
+			addr := addr
+			listen = append(listen, func() (net.Listener, error) { return net.Listen("tcp", addr) })
 		}
-	}()
+	}
+
+	errCh := make(chan error, len(listen))
+	for _, l := range listen {
+		go func(listen func() (net.Listener, error)) {
+			var err error
+			defer func() { errCh <- err }()
+
+			l, err := listen()
+			if err != nil {
+				err = fmt.Errorf("Failed to setup http server: %v", err)
+				return
+			}
+			if err = server.Serve(l); err == http.ErrServerClosed {
+				err = nil
+				if res.ctx.Err() != nil {
+					logging.Verbose.Println("Not serving http requests any more.")
+				} else {
+					logging.Error.Println("Not serving http requests any more.")
+				}
+			} else if err != nil {
+				err = fmt.Errorf("Failed to setup http server: %v", err)
+			}
+		}(l)
+	}
 	return errCh
 }
 
@@ -485,6 +855,81 @@ func (res *Resolver) RestConfig(req *restful.Request, resp *restful.Response) {
 	io.WriteString(resp, string(output))
 }
 
+// Reports the state of the records of Domain through REST interface: the
+// serial, when they last changed and when the master was last checked for
+// changes
+func (res *Resolver) RestStatus(req *restful.Request, resp *restful.Response) {
+	output, err := json.Marshal(res.zones[0].status())
+	if err != nil {
+		logging.Error.Println(err)
+	}
+	io.WriteString(resp, string(output))
+}
+
+// Reports the state and health of the records of every cluster through
+// REST interface
+func (res *Resolver) RestClusters(req *restful.Request, resp *restful.Response) {
+	mapC := make([]map[string]interface{}, 0, len(res.zones))
+	for _, z := range res.zones {
+		mapC = append(mapC, z.status())
+	}
+	output, err := json.Marshal(mapC)
+	if err != nil {
+		logging.Error.Println(err)
+	}
+	io.WriteString(resp, string(output))
+}
+
+// Reports through REST interface whether the records of every cluster are
+// served, with their staleness, and 503 Service Unavailable if any isn't
+func (res *Resolver) RestHealth(req *restful.Request, resp *restful.Response) {
+	healthy := true
+	clusters := make([]map[string]interface{}, 0, len(res.zones))
+	for _, z := range res.zones {
+		status := z.status()
+		healthy = healthy && status["Serving"].(bool)
+		clusters = append(clusters, map[string]interface{}{
+			"Domain":    status["Domain"],
+			"Serving":   status["Serving"],
+			"Staleness": status["Staleness"],
+			"Error":     status["Error"],
+		})
+	}
+	output, err := json.Marshal(map[string]interface{}{
+		"Healthy":  healthy,
+		"Clusters": clusters,
+	})
+	if err != nil {
+		logging.Error.Println(err)
+	}
+	if !healthy {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	io.WriteString(resp, string(output))
+}
+
+// Reports the health of the servers of every stub zone through REST
+// interface
+func (res *Resolver) RestStubZones(req *restful.Request, resp *restful.Response) {
+	mapS := make([]map[string]interface{}, 0, len(res.stubs))
+	for _, s := range res.stubs {
+		mapS = append(mapS, s.status())
+	}
+	output, err := json.Marshal(mapS)
+	if err != nil {
+		logging.Error.Println(err)
+	}
+	io.WriteString(resp, string(output))
+}
+
+// formatTime formats t as RFC 3339, or as "" if t is zero
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
 // Reports Mesos-DNS version through REST interface
 func (res *Resolver) RestVersion(req *restful.Request, resp *restful.Response) {
 	mapV := map[string]string{"Service": "Mesos-DNS",
@@ -502,19 +947,24 @@ func (res *Resolver) RestHost(req *restful.Request, resp *restful.Response) {
 
 	host := req.PathParameter("host")
 	// clean up host name
-	dom := strings.ToLower(cleanWild(host))
+	dom := strings.ToLower(host)
 	if dom[len(dom)-1] != '.' {
 		dom += "."
 	}
 
 	mapH := make([]map[string]string, 0)
-	rs := res.records()
+	var ips []dns.RR
+	z := res.zoneOf(dom)
+	if z != nil {
+		rs := z.records()
+		ips = uniqueRRs(rs, rs.Match(dom, z.config.Domain), dns.TypeA)
+	}
 
-	for _, ip := range rs.As[dom] {
-		t := map[string]string{"host": dom, "ip": ip}
+	for _, rr := range ips {
+		t := map[string]string{"host": dom, "ip": rr.(*dns.A).A.String()}
 		mapH = append(mapH, t)
 	}
-	empty := (len(rs.As[dom]) == 0)
+	empty := (len(ips) == 0)
 	if empty {
 		t := map[string]string{"host": "", "ip": ""}
 		mapH = append(mapH, t)
@@ -527,17 +977,16 @@ func (res *Resolver) RestHost(req *restful.Request, resp *restful.Response) {
 	io.WriteString(resp, string(output))
 
 	// stats
-	mesosrq := strings.HasSuffix(dom, res.config.Domain+".")
-	if mesosrq {
-		logging.CurLog.MesosRequests.Inc()
+	if z != nil {
+		res.metrics.MesosRequests.Inc()
 		if empty {
-			logging.CurLog.MesosNXDomain.Inc()
+			res.metrics.MesosNXDomain.Inc()
 		} else {
-			logging.CurLog.MesosSuccess.Inc()
+			res.metrics.MesosSuccess.Inc()
 		}
 	} else {
-		logging.CurLog.NonMesosRequests.Inc()
-		logging.CurLog.NonMesosFailed.Inc()
+		res.metrics.NonMesosRequests.Inc()
+		res.metrics.NonMesosFailed.Inc()
 	}
 
 }
@@ -555,28 +1004,32 @@ func (res *Resolver) RestService(req *restful.Request, resp *restful.Response) {
 	service := req.PathParameter("service")
 
 	// clean up service name
-	dom := strings.ToLower(cleanWild(service))
+	dom := strings.ToLower(service)
 	if dom[len(dom)-1] != '.' {
 		dom += "."
 	}
 
 	mapS := make([]map[string]string, 0)
-	rs := res.records()
+	var srvs []dns.RR
+	z := res.zoneOf(dom)
+	if z != nil {
+		rs := z.records()
+		srvs = uniqueRRs(rs, rs.Match(dom, z.config.Domain), dns.TypeSRV)
+	}
 
-	for _, srv := range rs.SRVs[dom] {
-		h, port, _ := net.SplitHostPort(srv)
-		p, _ := strconv.Atoi(port)
-		if len(rs.As[h]) != 0 {
-			ip = rs.As[h][0]
+	for _, rr := range srvs {
+		srv := rr.(*dns.SRV)
+		if a := z.records().Lookup(srv.Target, dns.TypeA); len(a) != 0 {
+			ip = a[0].RR.(*dns.A).A.String()
 		} else {
 			ip = ""
 		}
 
-		t := map[string]string{"service": service, "host": h, "ip": ip, "port": strconv.Itoa(p)}
+		t := map[string]string{"service": service, "host": srv.Target, "ip": ip, "port": strconv.Itoa(int(srv.Port))}
 		mapS = append(mapS, t)
 	}
 
-	empty := (len(rs.SRVs[dom]) == 0)
+	empty := (len(srvs) == 0)
 	if empty {
 		t := map[string]string{"service": "", "host": "", "ip": "", "port": ""}
 		mapS = append(mapS, t)
@@ -589,17 +1042,16 @@ func (res *Resolver) RestService(req *restful.Request, resp *restful.Response) {
 	io.WriteString(resp, string(output))
 
 	// stats
-	mesosrq := strings.HasSuffix(dom, res.config.Domain+".")
-	if mesosrq {
-		logging.CurLog.MesosRequests.Inc()
+	if z != nil {
+		res.metrics.MesosRequests.Inc()
 		if empty {
-			logging.CurLog.MesosNXDomain.Inc()
+			res.metrics.MesosNXDomain.Inc()
 		} else {
-			logging.CurLog.MesosSuccess.Inc()
+			res.metrics.MesosSuccess.Inc()
 		}
 	} else {
-		logging.CurLog.NonMesosRequests.Inc()
-		logging.CurLog.NonMesosFailed.Inc()
+		res.metrics.NonMesosRequests.Inc()
+		res.metrics.NonMesosFailed.Inc()
 	}
 
 }
@@ -620,60 +1072,100 @@ func panicRecover(f func(w dns.ResponseWriter, r *dns.Msg)) func(w dns.ResponseW
 	}
 }
 
-// Start a Zookeeper listener to track leading master, returns a signal chan
-// that closes upon the first leader detection notification (and c.leader is
-// meaningfully readable).
-func (res *Resolver) ZKdetect(leaderChanged func(bool)) (<-chan struct{}, error) {
+// mesosTypes are the types of records HandleMesos answers with on their
+// own, the records of other types are answered as they are stored. the
+// SOA and NS records of the domain are never stored.
+var mesosTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeSRV:   true,
+	dns.TypeTXT:   true,
+	dns.TypeCNAME: true,
+}
 
-	// start listener
-	logging.Verbose.Println("Starting master detector for ZK ", res.config.Zk)
-	md, err := detector.New(res.config.Zk)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create master detector: %v", err)
-	}
-
-	// and listen for master changes
-	var startedOnce sync.Once
-	started := make(chan struct{})
-	if err := md.Detect(detector.OnMasterChanged(func(info *mesos.MasterInfo) {
-		// making this atomic
-		res.leaderLock.Lock()
-		defer res.leaderLock.Unlock()
-		if leaderChanged != nil {
-			defer func() {
-				leaderChanged(res.leader != "")
-			}()
-		}
-		logging.VeryVerbose.Println("Updated Zookeeper info: ", info)
-		if info == nil {
-			res.leader = ""
-			logging.Error.Println("No leader available in Zookeeper.")
-		} else if host := info.GetHostname(); host != "" {
-			res.leader = host
-		} else {
-			// unpack IPv4
-			octets := make([]byte, 4, 4)
-			binary.BigEndian.PutUint32(octets, info.GetIp())
-			ipv4 := net.IP(octets)
-			res.leader = ipv4.String()
+// otherTypes returns the types of the records of all the names other than
+// mesosTypes, sorted
+func otherTypes(rs *records.RecordGenerator, names []string) []uint16 {
+	seen := make(map[uint16]bool)
+	var types []uint16
+	for _, name := range names {
+		for t := range rs.Records[name] {
+			if !mesosTypes[t] && !seen[t] {
+				seen[t] = true
+				types = append(types, t)
+			}
 		}
-		if len(res.leader) > 0 {
-			res.leader = fmt.Sprintf("%s:%d", res.leader, info.GetPort())
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// uniqueRRs returns the records of type qtype of all the names, without
+// duplicates. The records are shared, see answer.
+func uniqueRRs(rs *records.RecordGenerator, names []string, qtype uint16) []dns.RR {
+	var unique []dns.RR
+	if len(names) == 1 {
+		for _, rec := range rs.Lookup(names[0], qtype) {
+			unique = append(unique, rec.RR)
+		}
+		return unique
+	}
+	seen := make(map[string]struct{})
+	for _, name := range names {
+		for _, rec := range rs.Lookup(name, qtype) {
+			// the records of different names differ only by their name
+			key := strings.TrimPrefix(rec.RR.String(), rec.RR.Header().String())
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				unique = append(unique, rec.RR)
+			}
 		}
-		logging.Verbose.Println("New master in Zookeeper ", res.leader)
-		startedOnce.Do(func() { close(started) })
-	})); err != nil {
-		return nil, fmt.Errorf("failed to initialize master detector: %v", err)
 	}
-	return started, nil
+	return unique
 }
 
-// cleanWild strips any wildcards out thus mapping cleanly to the
-// original serviceName
-func cleanWild(dom string) string {
-	if strings.Contains(dom, ".*") {
-		return strings.Replace(dom, ".*", "", -1)
-	} else {
-		return dom
+// truncate drops the records of a UDP answer that don't fit in the UDP
+// size of the client, 512 bytes or its EDNS0 buffer size, and sets TC so
+// that the client retries over TCP
+func truncate(w dns.ResponseWriter, r *dns.Msg, m *dns.Msg) {
+	if _, udp := w.RemoteAddr().(*net.UDPAddr); !udp {
+		return
+	}
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if m.Len() <= size {
+		return
+	}
+	m.Truncated = true
+	m.Extra = nil
+	for len(m.Answer) > 0 && m.Len() > size {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+	}
+	if m.Len() > size {
+		m.Ns = nil
+	}
+}
+
+// capTTL lowers the TTL of the records to at most ttl. The records are
+// shared, see answer, so those with a higher TTL are replaced by copies.
+func capTTL(rrs []dns.RR, ttl uint32) {
+	for i, rr := range rrs {
+		if rr.Header().Ttl > ttl {
+			rrs[i] = dns.Copy(rr)
+			rrs[i].Header().Ttl = ttl
+		}
+	}
+}
+
+// answer returns rr as an answer for name. The precomputed records are
+// shared by all the queries, so the records of other names (matched by a
+// wildcard) are copied to take name instead of being modified.
+func answer(rr dns.RR, name string) dns.RR {
+	if rr.Header().Name == name {
+		return rr
 	}
+	rr = dns.Copy(rr)
+	rr.Header().Name = name
+	return rr
 }
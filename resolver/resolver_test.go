@@ -1,14 +1,23 @@
 package resolver
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"github.com/mesos/mesos-go/detector"
 	"github.com/mesosphere/mesos-dns/logging"
 	"github.com/mesosphere/mesos-dns/records"
 	"github.com/miekg/dns"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -18,65 +27,17 @@ func init() {
 	logging.SetupLogs()
 }
 
-// dig @127.0.0.1 -p 8053 "bob.*.mesos" ANY
-func TestCleanWild(t *testing.T) {
-	dom := "bob.*.mesos"
-
-	stripped := cleanWild(dom)
-
-	if stripped != "bob.mesos" {
-		t.Error("not stripping domain")
-	}
-}
-
-func TestShuffleAnswers(t *testing.T) {
-	var res Resolver
-
-	m := new(dns.Msg)
-
-	for i := 0; i < 10; i++ {
-		name := "10.0.0." + strconv.Itoa(i)
-		rr, err := res.formatA("blah.com", name)
-		if err != nil {
-			t.Error(err)
-		}
-		m.Answer = append(m.Answer, rr)
-	}
-
-	n := new(dns.Msg)
-	c := make([]dns.RR, len(m.Answer))
-	copy(c, m.Answer)
-	n.Answer = c
-
-	_ = shuffleAnswers(m.Answer)
-
-	sflag := false
-	// 10! chance of failing here
-	for i := 0; i < 10; i++ {
-		if n.Answer[i] != m.Answer[i] {
-			sflag = true
-			break
-		}
-	}
-
-	if !sflag {
-		t.Error("not shuffling")
-	}
-}
-
-func fakeDNS(port int) (*Resolver, error) {
+func fakeDNS(opts ...Option) (*Resolver, error) {
 	res := New("", records.Config{
 		Masters:    []string{"144.76.157.37:5050"},
 		TTL:        60,
-		Port:       port,
 		Domain:     "mesos",
 		Resolvers:  records.GetLocalDNS(),
 		Listener:   "127.0.0.1",
 		SOARname:   "root.ns1.mesos.",
 		SOAMname:   "ns1.mesos.",
-		HttpPort:   8123,
 		ExternalOn: true,
-	})
+	}, opts...)
 
 	b, err := ioutil.ReadFile("../factories/fake.json")
 	if err != nil {
@@ -89,14 +50,32 @@ func fakeDNS(port int) (*Resolver, error) {
 		return res, err
 	}
 
-	masters := []string{"144.76.157.37:5050"}
-	res.rs = &records.RecordGenerator{}
-	res.rs.InsertState(sj, "mesos", "mesos-dns.mesos.", "127.0.0.1", masters)
+	rs := &records.RecordGenerator{}
+	rs.InsertState(sj, res.config)
+	res.zones[0].publish(rs)
 
 	return res, nil
 }
 
-func fakeMsg(dom string, rrHeader uint16, proto string) (*dns.Msg, error) {
+// fakeListeners binds UDP and TCP listeners to the same ephemeral port of
+// the loopback address
+func fakeListeners(t *testing.T) (net.PacketConn, net.Listener, string) {
+	for i := 0; i < 10; i++ {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, l, pc.LocalAddr().String()
+		}
+		pc.Close()
+	}
+	t.Fatal("no free port")
+	return nil, nil, ""
+}
+
+func fakeMsg(addr string, dom string, rrHeader uint16, proto string) (*dns.Msg, error) {
 	qc := uint16(dns.ClassINET)
 
 	c := new(dns.Client)
@@ -110,13 +89,13 @@ func fakeMsg(dom string, rrHeader uint16, proto string) (*dns.Msg, error) {
 		Qclass: qc,
 	}
 
-	in, _, err := c.Exchange(m, "127.0.0.1:8053")
+	in, _, err := c.Exchange(m, addr)
 	return in, err
 
 }
 
-func fakeQuery(dom string, rrHeader uint16, proto string) ([]dns.RR, error) {
-	in, err := fakeMsg(dom, rrHeader, proto)
+func fakeQuery(addr string, dom string, rrHeader uint16, proto string) ([]dns.RR, error) {
+	in, err := fakeMsg(addr, dom, rrHeader, proto)
 	if err != nil {
 		return in.Answer, err
 	}
@@ -139,20 +118,16 @@ func identicalResults(msg_a []dns.RR, msg_b []dns.RR) bool {
 func TestHandler(t *testing.T) {
 	var msg []dns.RR
 
-	res, err := fakeDNS(8053)
+	pc, l, addr := fakeListeners(t)
+	res, err := fakeDNS(WithPacketConn(pc), WithListener(l))
 	if err != nil {
 		t.Error(err)
 	}
-
-	dns.HandleFunc("mesos.", res.HandleMesos)
-	go res.Serve("udp")
-	go res.Serve("tcp")
-
-	// wait for startup ? lame
-	time.Sleep(10 * time.Millisecond)
+	res.LaunchDNS()
+	defer res.Stop(context.Background())
 
 	// test A records
-	msg, err = fakeQuery("chronos.marathon.mesos.", dns.TypeA, "udp")
+	msg, err = fakeQuery(addr, "chronos.marathon.mesos.", dns.TypeA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -163,7 +138,7 @@ func TestHandler(t *testing.T) {
 
 	// Test case sensitivity -- this test depends on one above
 	msg_a := msg
-	msg, err = fakeQuery("cHrOnOs.MARATHON.mesoS.", dns.TypeA, "udp")
+	msg, err = fakeQuery(addr, "cHrOnOs.MARATHON.mesoS.", dns.TypeA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -173,7 +148,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test SRV record
-	msg, err = fakeQuery("_liquor-store._udp.marathon.mesos.", dns.TypeSRV, "udp")
+	msg, err = fakeQuery(addr, "_liquor-store._udp.marathon.mesos.", dns.TypeSRV, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -182,8 +157,20 @@ func TestHandler(t *testing.T) {
 		t.Error("not serving up SRV records")
 	}
 
+	// test TXT record
+	msg, err = fakeQuery(addr, "chronos.marathon.mesos.", dns.TypeTXT, "udp")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(msg) != 1 {
+		t.Error("not serving up TXT records")
+	} else if txt := msg[0].(*dns.TXT).Txt; len(txt) != 3 || txt[0] != "task_id=chronos.49b91a9a-3dda-11e4-a088-c20493233aa5" {
+		t.Errorf("not serving up the task ids in TXT records: %q", txt)
+	}
+
 	// test SOA
-	m, err := fakeMsg("non-existing.mesos.", dns.TypeSOA, "udp")
+	m, err := fakeMsg(addr, "non-existing.mesos.", dns.TypeSOA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -193,7 +180,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test NS
-	m, err = fakeMsg("non-existing2.mesos.", dns.TypeNS, "udp")
+	m, err = fakeMsg(addr, "non-existing2.mesos.", dns.TypeNS, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -203,7 +190,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test non-existing host
-	m, err = fakeMsg("missing.mesos.", dns.TypeA, "udp")
+	m, err = fakeMsg(addr, "missing.mesos.", dns.TypeA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -213,7 +200,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test tcp
-	msg, err = fakeQuery("chronos.marathon.mesos.", dns.TypeA, "tcp")
+	msg, err = fakeQuery(addr, "chronos.marathon.mesos.", dns.TypeA, "tcp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -223,7 +210,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test AAAA --> NODATA
-	m, err = fakeMsg("chronos.marathon.mesos.", dns.TypeAAAA, "udp")
+	m, err = fakeMsg(addr, "chronos.marathon.mesos.", dns.TypeAAAA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -233,7 +220,7 @@ func TestHandler(t *testing.T) {
 	}
 
 	// test AAAA --> NXDOMAIN
-	m, err = fakeMsg("missing.mesos.", dns.TypeAAAA, "udp")
+	m, err = fakeMsg(addr, "missing.mesos.", dns.TypeAAAA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -242,25 +229,107 @@ func TestHandler(t *testing.T) {
 		t.Error("not setting NXDOMAIN for AAAA requests")
 	}
 
+	// test wildcards
+	wildcards := map[string]int{
+		"*.marathon.mesos.":           2,
+		"liquor-store.*.mesos.":       2,
+		"_liquor-store._tcp.*.mesos.": 3,
+		"*.mesos.":                    6,
+	}
+	for name, n := range wildcards {
+		qType := dns.TypeA
+		if strings.HasPrefix(name, "_") {
+			qType = dns.TypeSRV
+		}
+		m, err = fakeMsg(addr, name, qType, "udp")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if m.Rcode != 0 || len(m.Answer) != n {
+			t.Errorf("expected %d answers for %s instead of %d", n, name, len(m.Answer))
+		}
+		for _, rr := range m.Answer {
+			if rr.Header().Name != name {
+				t.Errorf("expected answers for %s instead of %s", name, rr.Header().Name)
+			}
+		}
+	}
+
+	// wildcard answers must not modify the shared records
+	for _, rec := range res.zones[0].records().Lookup("liquor-store.marathon.mesos.", dns.TypeA) {
+		if rec.RR.Header().Name != "liquor-store.marathon.mesos." {
+			t.Errorf("modified the record of liquor-store.marathon.mesos.: %s", rec.RR)
+		}
+	}
+
+	m, err = fakeMsg(addr, "*.missing.mesos.", dns.TypeA, "udp")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if m.Rcode != 3 {
+		t.Error("not setting NXDOMAIN for unmatched wildcards")
+	}
+
+	// test SOA and NS of the domain
+	for _, qType := range []uint16{dns.TypeSOA, dns.TypeNS} {
+		m, err = fakeMsg(addr, "mesos.", qType, "udp")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if m.Rcode != 0 || len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != qType {
+			t.Errorf("not serving up %s records in the answer section", dns.TypeToString[qType])
+		}
+	}
+
+	// test NODATA for other types, and for names without records
+	nodata := map[string]uint16{
+		"leader.mesos.":           dns.TypeTXT,
+		"chronos.marathon.mesos.": dns.TypeMX,
+		"marathon.mesos.":         dns.TypeSOA,
+		"_tcp.marathon.mesos.":    dns.TypeA,
+		"mesos.":                  dns.TypeA,
+	}
+	for name, qType := range nodata {
+		m, err = fakeMsg(addr, name, qType, "udp")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if m.Rcode != 0 || len(m.Answer) > 0 || len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("not setting NODATA for %s %s requests", name, dns.TypeToString[qType])
+		}
+	}
+
+	// test NXDOMAIN for any type
+	for _, qType := range []uint16{dns.TypeSRV, dns.TypeSOA, dns.TypeNS, dns.TypeTXT} {
+		m, err = fakeMsg(addr, "missing.mesos.", qType, "udp")
+		if err != nil {
+			t.Error(err)
+		}
+
+		if m.Rcode != 3 || len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("not setting NXDOMAIN for %s requests", dns.TypeToString[qType])
+		}
+	}
+
 }
 
 func TestNonMesosHandler(t *testing.T) {
 	var msg []dns.RR
 
-	res, err := fakeDNS(8054)
+	pc, l, addr := fakeListeners(t)
+	res, err := fakeDNS(WithPacketConn(pc), WithListener(l))
 	if err != nil {
 		t.Error(err)
 	}
-
-	dns.HandleFunc(".", res.HandleNonMesos)
-	go res.Serve("udp")
-	go res.Serve("tcp")
-
-	// wait for startup ? lame
-	time.Sleep(200 * time.Millisecond)
+	res.LaunchDNS()
+	defer res.Stop(context.Background())
 
 	// test A records
-	msg, err = fakeQuery("google.com", dns.TypeA, "udp")
+	msg, err = fakeQuery(addr, "google.com", dns.TypeA, "udp")
 	if err != nil {
 		t.Error(err)
 	}
@@ -274,22 +343,21 @@ func TestNonMesosHandler(t *testing.T) {
 func TestHTTP(t *testing.T) {
 
 	// setup DNS server (just http)
-	res, err := fakeDNS(8053)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := fakeDNS(WithHTTPListener(l))
 	if err != nil {
 		t.Error(err)
 	}
 	res.version = "0.1.1"
 
 	errCh := res.LaunchHTTP()
-	go func() {
-		err := <-errCh
-		t.Fatalf("HTTP server stopped with err: %v", err)
-	}()
-	// wait for startup ? lame
-	time.Sleep(10 * time.Millisecond)
+	url := "http://" + l.Addr().String()
 
 	// test /v1/version
-	r1, err := http.Get("http://127.0.0.1:8123/v1/version")
+	r1, err := http.Get(url + "/v1/version")
 	if err != nil {
 		t.Error(err)
 	}
@@ -306,7 +374,7 @@ func TestHTTP(t *testing.T) {
 	}
 
 	// test /v1/config
-	r2, err := http.Get("http://127.0.0.1:8123/v1/config")
+	r2, err := http.Get(url + "/v1/config")
 	if err != nil {
 		t.Error(err)
 	}
@@ -322,7 +390,7 @@ func TestHTTP(t *testing.T) {
 	}
 
 	// test /v1/services -- existing record
-	r3, err := http.Get("http://127.0.0.1:8123/v1/services/_leader._tcp.mesos.")
+	r3, err := http.Get(url + "/v1/services/_leader._tcp.mesos.")
 	if err != nil {
 		t.Error(err)
 	}
@@ -339,7 +407,7 @@ func TestHTTP(t *testing.T) {
 	}
 
 	// test /v1/services -- non existing record
-	r4, err := http.Get("http://127.0.0.1:8123/v1/services/_myservice._tcp.mesos.")
+	r4, err := http.Get(url + "/v1/services/_myservice._tcp.mesos.")
 	if err != nil {
 		t.Error(err)
 	}
@@ -356,7 +424,7 @@ func TestHTTP(t *testing.T) {
 	}
 
 	// test /v1/host -- existing record
-	r5, err := http.Get("http://127.0.0.1:8123/v1/hosts/leader.mesos")
+	r5, err := http.Get(url + "/v1/hosts/leader.mesos")
 	if err != nil {
 		t.Error(err)
 	}
@@ -372,4 +440,675 @@ func TestHTTP(t *testing.T) {
 		t.Error("Http hosts API failure")
 	}
 
+	// test /v1/status
+	r6, err := http.Get(url + "/v1/status")
+	if err != nil {
+		t.Error(err)
+	}
+	g6, err := ioutil.ReadAll(r6.Body)
+	if err != nil {
+		t.Error(err)
+	}
+	var got6 map[string]interface{}
+	err = json.Unmarshal(g6, &got6)
+	snap := res.zones[0].snapshot()
+	if got6["Serial"] != float64(snap.serial) || got6["Hash"] != snap.rs.Hash() || got6["LastChanged"] == "" {
+		t.Errorf("Http status API failure: %v", got6)
+	}
+
+	select {
+	case err := <-errCh:
+		t.Fatalf("HTTP server stopped with err: %v", err)
+	default:
+	}
+}
+
+// fakeWriter is a dns.ResponseWriter that keeps the last message written
+type fakeWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+func (w *fakeWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *fakeWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53000}
+}
+
+// fakeMaster returns a mesos master serving ../factories/fake.json as the
+// leader, update is called to change the state before every request
+func fakeMaster(update func(sj *records.StateJSON)) (*httptest.Server, error) {
+	b, err := ioutil.ReadFile("../factories/fake.json")
+	if err != nil {
+		return nil, err
+	}
+	var sj records.StateJSON
+	if err = json.Unmarshal(b, &sj); err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/master/state.json" {
+			http.NotFound(w, r)
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if update != nil {
+			update(&sj)
+		}
+		if err := json.NewEncoder(w).Encode(sj); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	sj.Leader = "master@" + master.Listener.Addr().String()
+	return master, nil
+}
+
+// fakeReloadConfig returns the config of a resolver reloading from master
+func fakeReloadConfig(master *httptest.Server) records.Config {
+	return records.Config{
+		Masters:  []string{master.Listener.Addr().String()},
+		TTL:      60,
+		Domain:   "mesos",
+		Listener: "127.0.0.1",
+		SOARname: "root.ns1.mesos.",
+		SOAMname: "ns1.mesos.",
+	}
+}
+
+func TestReloadUnchanged(t *testing.T) {
+	master, err := fakeMaster(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	res := New("", fakeReloadConfig(master))
+	res.Reload()
+	first := res.zones[0].snapshot()
+	if first.changed.IsZero() || len(first.rs.Lookup("leader.mesos.", dns.TypeA)) != 1 {
+		t.Fatal("should serve the reloaded records")
+	}
+	checked := res.zones[0].checked.Load().(time.Time)
+
+	time.Sleep(10 * time.Millisecond)
+	res.Reload()
+	if snap := res.zones[0].snapshot(); snap != first {
+		t.Errorf("should keep serial %d for unchanged records instead of %d", first.serial, snap.serial)
+	}
+	if !res.zones[0].checked.Load().(time.Time).After(checked) {
+		t.Error("should update the time of the last check")
+	}
+}
+
+func TestReloadConcurrentQueries(t *testing.T) {
+	// every reload changes the port of a slave
+	port := 5051
+	master, err := fakeMaster(func(sj *records.StateJSON) {
+		port++
+		sj.Slaves[0].Pid = "slave(1)@" + sj.Slaves[0].Hostname + ":" + strconv.Itoa(port)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	res := New("", fakeReloadConfig(master))
+	res.Reload()
+
+	// every serial must be served with a single record set
+	type seen map[uint32]*records.RecordGenerator
+	done := make(chan struct{})
+	results := make(chan seen)
+	for i := 0; i < 4; i++ {
+		go func() {
+			s := make(seen)
+			w := &fakeWriter{}
+			for {
+				select {
+				case <-done:
+					results <- s
+					return
+				default:
+				}
+
+				snap := res.zones[0].snapshot()
+				if rs, ok := s[snap.serial]; ok && rs != snap.rs {
+					s[snap.serial] = nil
+				} else {
+					s[snap.serial] = snap.rs
+				}
+
+				for _, name := range []string{"leader.mesos.", "missing.mesos."} {
+					r := new(dns.Msg)
+					r.SetQuestion(name, dns.TypeA)
+					res.HandleMesos(w, r)
+				}
+				if len(w.msg.Ns) != 1 || w.msg.Ns[0].(*dns.SOA).Serial < snap.serial {
+					s[snap.serial] = nil
+				}
+			}
+		}()
+	}
+
+	first := res.zones[0].snapshot().serial
+	for i := 0; i < 10; i++ {
+		res.Reload()
+	}
+	close(done)
+
+	for i := 0; i < 4; i++ {
+		for serial, rs := range <-results {
+			if rs == nil {
+				t.Errorf("inconsistent records or SOA for serial %d", serial)
+			}
+		}
+	}
+	if last := res.zones[0].snapshot().serial; last-first < 10 {
+		t.Errorf("expected a serial of at least %d after 10 reloads instead of %d", first+10, last)
+	}
+	if len(res.zones[0].records().Lookup("leader.mesos.", dns.TypeA)) != 1 {
+		t.Error("should serve the reloaded records")
+	}
+}
+
+func TestReloadStateFile(t *testing.T) {
+	res := New("", records.Config{
+		TTL:       60,
+		Domain:    "mesos",
+		Listener:  "127.0.0.1",
+		SOARname:  "root.ns1.mesos.",
+		SOAMname:  "ns1.mesos.",
+		StateFile: "../factories/fake.json",
+	})
+	res.Reload()
+	if len(res.zones[0].records().Lookup("liquor-store.marathon.mesos.", dns.TypeA)) == 0 {
+		t.Error("should load the records from the state file")
+	}
+}
+
+func TestHandleMesosAliases(t *testing.T) {
+	res := New("", records.Config{
+		TTL:       60,
+		Domain:    "mesos",
+		Listener:  "127.0.0.1",
+		SOARname:  "root.ns1.mesos.",
+		SOAMname:  "ns1.mesos.",
+		StateFile: "../factories/fake.json",
+		Aliases: map[string]string{
+			"store":  "liquor-store.marathon",
+			"shop":   "store",
+			"legacy": "legacy.example.com.",
+		},
+		StaticRecords: []string{"loop1 IN CNAME loop2", "loop2 IN CNAME loop1"},
+	})
+	res.Reload()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &fakeWriter{}
+		res.HandleMesos(w, new(dns.Msg).SetQuestion(name, qtype))
+		return w.msg
+	}
+
+	m := query("shop.mesos.", dns.TypeCNAME)
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.CNAME).Target != "store.mesos." {
+		t.Errorf("expected the CNAME record of the alias instead of %v", m.Answer)
+	}
+
+	m = query("shop.mesos.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) < 3 {
+		t.Fatalf("expected the chain and the A records of its end instead of %v", m)
+	}
+	for i, target := range []string{"store.mesos.", "liquor-store.marathon.mesos."} {
+		if cname, ok := m.Answer[i].(*dns.CNAME); !ok || cname.Target != target {
+			t.Errorf("expected a CNAME record to %s instead of %s", target, m.Answer[i])
+		}
+	}
+	for _, rr := range m.Answer[2:] {
+		if a, ok := rr.(*dns.A); !ok || a.Hdr.Name != "liquor-store.marathon.mesos." {
+			t.Errorf("expected an A record of the end of the chain instead of %s", rr)
+		}
+	}
+
+	// the SRV records of the task are under _liquor-store._tcp
+	m = query("store.mesos.", dns.TypeSRV)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || len(m.Ns) != 1 {
+		t.Errorf("expected the chain and the SOA record for a NODATA end instead of %v", m)
+	}
+
+	m = query("legacy.mesos.", dns.TypeA)
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 {
+		t.Errorf("expected only the CNAME record of an alias outside of the domain instead of %v", m)
+	}
+
+	m = query("loop1.mesos.", dns.TypeA)
+	if m.Rcode != dns.RcodeServerFailure || len(m.Answer) != 0 {
+		t.Errorf("expected SERVFAIL for a CNAME loop instead of %v", m)
+	}
+}
+
+func TestHandleMesosStaticTypes(t *testing.T) {
+	res := New("", records.Config{
+		TTL:       60,
+		Domain:    "mesos",
+		Listener:  "127.0.0.1",
+		SOARname:  "root.ns1.mesos.",
+		SOAMname:  "ns1.mesos.",
+		StateFile: "../factories/fake.json",
+		StaticRecords: []string{
+			"mail IN A 10.0.0.25",
+			"mail IN MX 10 mail",
+			"mail IN AAAA 2001:db8::25",
+			"east IN NS ns.east",
+		},
+	})
+	res.Reload()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		w := &fakeWriter{}
+		res.HandleMesos(w, new(dns.Msg).SetQuestion(name, qtype))
+		return w.msg
+	}
+
+	for _, qtype := range []uint16{dns.TypeMX, dns.TypeAAAA} {
+		if m := query("mail.mesos.", qtype); len(m.Answer) != 1 || m.Answer[0].Header().Rrtype != qtype {
+			t.Errorf("expected the static %s record instead of %v", dns.TypeToString[qtype], m)
+		}
+	}
+	if m := query("mail.mesos.", dns.TypeANY); len(m.Answer) != 3 {
+		t.Errorf("expected the A, MX and AAAA records for ANY instead of %v", m.Answer)
+	}
+	if m := query("east.mesos.", dns.TypeNS); len(m.Answer) != 1 || m.Answer[0].(*dns.NS).Ns != "ns.east.mesos." {
+		t.Errorf("expected the static NS record of the subdomain instead of %v", m)
+	}
+	if m := query("mesos.", dns.TypeNS); len(m.Answer) != 1 || m.Answer[0].(*dns.NS).Ns != "ns1.mesos." {
+		t.Errorf("expected only the NS record of the domain instead of %v", m)
+	}
+	if m := query("mail.mesos.", dns.TypePTR); m.Rcode != dns.RcodeSuccess || len(m.Answer) != 0 {
+		t.Errorf("expected NODATA without records of the type instead of %v", m)
+	}
+}
+
+func TestRoundRobinReset(t *testing.T) {
+	config := records.Config{
+		TTL:           60,
+		Domain:        "mesos",
+		SOARname:      "root.ns1.mesos.",
+		SOAMname:      "ns1.mesos.",
+		AnswerOrder:   "roundrobin",
+		StaticRecords: []string{"web IN A 10.0.0.1", "web IN A 10.0.0.2"},
+	}
+	res := New("", config)
+	publish := func(static ...string) {
+		c := config
+		c.StaticRecords = append(c.StaticRecords, static...)
+		rs := &records.RecordGenerator{}
+		if err := rs.InsertState(records.StateJSON{Leader: "master@10.0.0.5:5050"}, c); err != nil {
+			t.Fatal(err)
+		}
+		res.zones[0].publish(rs)
+	}
+	first := func() string {
+		w := &fakeWriter{}
+		res.HandleMesos(w, new(dns.Msg).SetQuestion("web.mesos.", dns.TypeA))
+		if len(w.msg.Answer) != 2 {
+			t.Fatalf("expected 2 answers instead of %v", w.msg.Answer)
+		}
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+
+	publish()
+	start := first()
+	if next := first(); next == start {
+		t.Errorf("expected the answers to rotate, found %s first twice", next)
+	}
+	publish("other IN A 10.0.0.3")
+	if next := first(); next != start {
+		t.Errorf("expected new records to start over with %s instead of %s", start, next)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	answer := func() *dns.Msg {
+		m := new(dns.Msg)
+		for i := 0; i < 100; i++ {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "app.marathon.mesos.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 0, 0, byte(i)),
+			})
+		}
+		return m
+	}
+	r := new(dns.Msg).SetQuestion("*.marathon.mesos.", dns.TypeA)
+
+	m := answer()
+	truncate(&fakeWriter{}, r, m)
+	if !m.Truncated || m.Len() > dns.MinMsgSize || len(m.Answer) == 0 {
+		t.Errorf("expected an answer truncated to %d bytes instead of %d", dns.MinMsgSize, m.Len())
+	}
+
+	m = answer()
+	truncate(&fakeWriter{}, r.SetEdns0(4096, false), m)
+	if m.Truncated || len(m.Answer) != 100 {
+		t.Errorf("expected the whole answer within the EDNS0 buffer size instead of %d records", len(m.Answer))
+	}
+}
+
+func TestClusters(t *testing.T) {
+	res := New("", records.Config{
+		TTL:       60,
+		Domain:    "mesos",
+		Listener:  "127.0.0.1",
+		SOARname:  "root.ns1.mesos.",
+		SOAMname:  "ns1.mesos.",
+		StateFile: "../factories/fake.json",
+		Clusters: []records.Cluster{
+			{Domain: "east.mesos", StateFile: "../factories/fake.json"},
+			{Domain: "west.mesos", StateFile: "../factories/missing.json"},
+		},
+	})
+	res.Reload()
+
+	query := func(name string) *dns.Msg {
+		w := &fakeWriter{}
+		res.HandleMesos(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		return w.msg
+	}
+	for _, name := range []string{"liquor-store.marathon.mesos.", "liquor-store.marathon.east.mesos."} {
+		if m := query(name); m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+			t.Errorf("expected the A records of %s instead of %v", name, m)
+		}
+	}
+	if m := query("liquor-store.marathon.west.mesos."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for a cluster without state instead of %v", m)
+	}
+
+	if soa := query("missing.east.mesos.").Ns; len(soa) != 1 || soa[0].Header().Name != "east.mesos." {
+		t.Errorf("expected the SOA record of the cluster instead of %v", soa)
+	}
+
+	for i, healthy := range []bool{true, true, false} {
+		status := res.zones[i].status()
+		if status["Healthy"] != healthy || (status["Error"] == "") != healthy {
+			t.Errorf("unexpected status of %s: %v", res.zones[i].apex, status)
+		}
+	}
+}
+
+func TestStaleRecords(t *testing.T) {
+	b, err := ioutil.ReadFile("../factories/fake.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mesos-dns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "state.json")
+	if err = ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res := New("", records.Config{
+		TTL:          60,
+		Domain:       "mesos",
+		Listener:     "127.0.0.1",
+		SOARname:     "root.ns1.mesos.",
+		SOAMname:     "ns1.mesos.",
+		StateFile:    file,
+		MaxStaleness: 600,
+		StaleTTL:     5,
+	})
+	query := func() *dns.Msg {
+		w := &fakeWriter{}
+		res.HandleMesos(w, new(dns.Msg).SetQuestion("liquor-store.marathon.mesos.", dns.TypeA))
+		return w.msg
+	}
+	z := res.zones[0]
+
+	// the first reload fails, the records were never loaded
+	missing := New("", records.Config{Domain: "mesos", StateFile: filepath.Join(dir, "missing.json")})
+	missing.Reload()
+	if status := missing.zones[0].status(); status["Error"] == "" || status["Serving"] != false || status["Staleness"] != 0 {
+		t.Errorf("unexpected status of records never loaded %v", status)
+	}
+
+	res.Reload()
+	if m := query(); len(m.Answer) == 0 || m.Answer[0].Header().Ttl != 60 {
+		t.Fatalf("expected fresh answers instead of %v", m)
+	}
+
+	os.Remove(file)
+	res.Reload()
+	m := query()
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		t.Fatalf("expected to serve the stale records instead of %v", m)
+	}
+	for _, rr := range m.Answer {
+		if rr.Header().Ttl != 5 {
+			t.Errorf("expected the stale TTL instead of %s", rr)
+		}
+	}
+	if rec := z.records().Lookup("liquor-store.marathon.mesos.", dns.TypeA); rec[0].RR.Header().Ttl != 60 {
+		t.Error("should not modify the shared records")
+	}
+
+	// stale for longer than MaxStaleness
+	z.checked.Store(time.Now().Add(-time.Hour))
+	if m = query(); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL for expired records instead of %v", m)
+	}
+	if status := z.status(); status["Serving"] != false || status["Staleness"].(int) < 3600 {
+		t.Errorf("unexpected status of expired records %v", status)
+	}
+
+	if err = ioutil.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	res.Reload()
+	if m = query(); m.Rcode != dns.RcodeSuccess || m.Answer[0].Header().Ttl != 60 {
+		t.Errorf("expected fresh answers once reloaded instead of %v", m)
+	}
+}
+
+// fakeDetector is a master detector that never detects a leader
+type fakeDetector struct {
+	done     chan struct{}
+	canceled sync.Once
+}
+
+func (d *fakeDetector) Detect(detector.MasterChanged) error { return nil }
+func (d *fakeDetector) Done() <-chan struct{}               { return d.done }
+func (d *fakeDetector) Cancel()                             { d.canceled.Do(func() { close(d.done) }) }
+
+func TestStop(t *testing.T) {
+	master, err := fakeMaster(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+
+	md := &fakeDetector{done: make(chan struct{})}
+	newDetector = func(string) (detector.Master, error) { return md, nil }
+	defer func() { newDetector = detector.New }()
+
+	config := fakeReloadConfig(master)
+	config.RefreshSeconds = 60
+	config.StateStream = true
+	config.Zk = "zk://127.0.0.1:2181/mesos"
+	pc, l, _ := fakeListeners(t)
+	res := New("", config, WithPacketConn(pc), WithListener(l))
+
+	served := res.LaunchDNS()
+	res.LaunchRefresh(time.Minute)
+	if !waitFor(res.zones[0].available) {
+		t.Fatal("should load the records")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = res.Stop(ctx); err != nil {
+		t.Fatalf("expected to stop instead of %v", err)
+	}
+	select {
+	case <-md.Done():
+	default:
+		t.Error("should cancel the master detector before returning")
+	}
+	for i := 0; i < 2; i++ {
+		if err = <-served; err != nil {
+			t.Errorf("expected the servers to stop instead of %v", err)
+		}
+	}
+
+	// the servers stay stopped
+	if err = res.serve("udp", "127.0.0.1:0", false); err != nil {
+		t.Errorf("should not serve once stopped, got %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	external := true
+	res, err := fakeDNS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.config.DNSListeners = []records.ListenAddr{
+		{Addr: "127.0.0.1:0", ExternalOn: &external},
+		{Addr: "127.0.0.1:0", ExternalOn: &external},
+	}
+
+	served := make(chan error, 1)
+	go func() { served <- res.Serve("udp") }()
+	if !waitFor(func() bool {
+		res.serversLock.Lock()
+		defer res.serversLock.Unlock()
+		return len(res.dnsServers) == 2
+	}) {
+		t.Fatal("should serve every configured address")
+	}
+	for _, server := range res.dnsServers {
+		if _, err = fakeQuery(server.PacketConn.LocalAddr().String(), "leader.mesos.", dns.TypeA, "udp"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = res.Stop(ctx); err != nil {
+		t.Fatalf("expected to stop instead of %v", err)
+	}
+	if err = <-served; err != nil {
+		t.Errorf("expected Serve to return once stopped instead of %v", err)
+	}
+}
+
+func TestResolvers(t *testing.T) {
+	// two resolvers in the same process, with their own handlers and
+	// counters
+	var addrs []string
+	var resolvers []*Resolver
+	for i := 0; i < 2; i++ {
+		pc, l, addr := fakeListeners(t)
+		res, err := fakeDNS(WithPacketConn(pc), WithListener(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.LaunchDNS()
+		defer res.Stop(context.Background())
+		addrs = append(addrs, addr)
+		resolvers = append(resolvers, res)
+	}
+
+	for i := 0; i < 3; i++ {
+		if msg, err := fakeQuery(addrs[1], "chronos.marathon.mesos.", dns.TypeA, "udp"); err != nil || len(msg) != 1 {
+			t.Fatalf("expected an answer of the second resolver instead of %v, %v", msg, err)
+		}
+	}
+	for i, n := range []string{"0", "3"} {
+		if got := resolvers[i].Metrics().MesosRequests.(fmt.Stringer).String(); got != n {
+			t.Errorf("expected %s requests to resolver %d instead of %s", n, i, got)
+		}
+	}
+
+	// the HTTP API without a server
+	w := httptest.NewRecorder()
+	resolvers[0].HTTPHandler().ServeHTTP(w, httptest.NewRequest("GET", "/v1/hosts/leader.mesos", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "1.2.3.4") {
+		t.Errorf("unexpected answer of the HTTP handler %d %s", w.Code, w.Body)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	// free addresses to configure
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		pc, l, addr := fakeListeners(t)
+		pc.Close()
+		l.Close()
+		addrs = append(addrs, addr)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpAddr := l.Addr().String()
+	l.Close()
+
+	on, off := true, false
+	res := New("", records.Config{
+		Domain:        "mesos",
+		TTL:           60,
+		Timeout:       1,
+		SOARname:      "root.ns1.mesos.",
+		SOAMname:      "ns1.mesos.",
+		Resolvers:     []string{"127.0.0.1"},
+		DNSListeners:  []records.ListenAddr{{Addr: addrs[0], ExternalOn: &on}, {Addr: addrs[1], ExternalOn: &off}},
+		HTTPListeners: []string{httpAddr},
+	})
+	res.zones[0].publish(&records.RecordGenerator{})
+	res.LaunchDNS()
+	res.LaunchHTTP()
+	defer res.Stop(context.Background())
+
+	query := func(addr string, name string, proto string) *dns.Msg {
+		var m *dns.Msg
+		waitFor(func() bool {
+			m, err = fakeMsg(addr, name, dns.TypeA, proto)
+			return err == nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	for _, addr := range addrs {
+		for _, proto := range []string{"udp", "tcp"} {
+			if m := query(addr, "leader.mesos.", proto); !m.Authoritative {
+				t.Errorf("expected an answer on %s over %s instead of %v", addr, proto, m)
+			}
+		}
+	}
+	if m := query(addrs[0], "example.com.", "udp"); m.Rcode == dns.RcodeRefused {
+		t.Errorf("expected to forward external requests on %s", addrs[0])
+	}
+	if m := query(addrs[1], "example.com.", "udp"); m.Rcode != dns.RcodeRefused {
+		t.Errorf("expected to refuse external requests on %s instead of %v", addrs[1], m)
+	}
+
+	var resp *http.Response
+	waitFor(func() bool {
+		resp, err = http.Get("http://" + httpAddr + "/v1/version")
+		return err == nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
 }
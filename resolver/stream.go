@@ -0,0 +1,100 @@
+package resolver
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/mesosphere/mesos-dns/util"
+)
+
+// launches the subscription to the event stream of the leading master,
+// returns immediately. the records are updated with every event while
+// subscribed, reload keeps polling state.json otherwise (e.g. with masters
+// older than 1.1). the subscription is retried every retry interval, until
+// ctx is done.
+func (z *zone) launchStream(ctx context.Context, retry time.Duration) {
+	// the latest state of the stream that publishStream hasn't taken yet
+	states := make(chan records.StateJSON, 1)
+	update := func(sj records.StateJSON) { z.streamUpdate(sj, states) }
+
+	z.running.Add(2)
+	go z.publishStream(ctx, states)
+	go func() {
+		defer util.HandleCrash()
+		defer z.running.Done()
+
+		for i := 0; ctx.Err() == nil; i++ {
+			addr := z.streamMaster(i)
+			if addr != "" {
+				err := records.Subscribe(ctx, addr, records.DefaultStreamTimeout, update)
+				if atomic.SwapInt32(&z.streaming, 0) == 1 && ctx.Err() == nil {
+					logging.Error.Println("event stream of master " + addr + " ended, polling state.json: " + err.Error())
+				} else if ctx.Err() == nil {
+					logging.VeryVerbose.Println("Warning: no event stream from master " + addr + ": " + err.Error())
+				}
+			}
+			select {
+			case <-time.After(retry):
+			case <-ctx.Done():
+			}
+		}
+	}()
+}
+
+// streamMaster returns the master to subscribe to on the given attempt,
+// the leader from Zookeeper if any or else each of the configured masters
+// in turn
+func (z *zone) streamMaster(attempt int) string {
+	z.leaderLock.RLock()
+	leader := z.leader
+	z.leaderLock.RUnlock()
+	if leader != "" {
+		return leader
+	}
+	if len(z.config.Masters) == 0 {
+		return ""
+	}
+	return z.config.Masters[attempt%len(z.config.Masters)]
+}
+
+// streamUpdate hands a state received from the event stream over to
+// publishStream, replacing the state it hasn't taken yet. it is called by
+// the goroutine reading the stream, which must not wait for the records.
+func (z *zone) streamUpdate(sj records.StateJSON, states chan records.StateJSON) {
+	if atomic.SwapInt32(&z.streaming, 1) == 0 {
+		logging.Verbose.Println("updating records from the event stream, " + strconv.Itoa(len(sj.Slaves)) + " slaves")
+	}
+
+	select {
+	case <-states:
+	default:
+	}
+	states <- sj
+}
+
+// publishStream publishes the records of the states of the event stream
+// until ctx is done. the addresses of the slaves and frameworks are kept
+// between states, so that only new host names are resolved.
+func (z *zone) publishStream(ctx context.Context, states <-chan records.StateJSON) {
+	defer util.HandleCrash()
+	defer z.running.Done()
+
+	hosts := records.NewHostCache()
+	for {
+		select {
+		case sj := <-states:
+			t := records.RecordGenerator{}
+			if err := t.InsertStateCached(sj, z.config, hosts); err != nil {
+				logging.Error.Println(err)
+				continue
+			}
+			z.publish(&t)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+// waitFor polls cond for up to a second
+func waitFor(cond func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestStreamFallback(t *testing.T) {
+	// a master without the operator API
+	var polls, subscribes int32
+	master, err := fakeMaster(func(*records.StateJSON) { atomic.AddInt32(&polls, 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer master.Close()
+	state := master.Config.Handler
+	master.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1" {
+			atomic.AddInt32(&subscribes, 1)
+		}
+		state.ServeHTTP(w, r)
+	})
+
+	config := fakeReloadConfig(master)
+	config.StateStream = true
+	config.RefreshSeconds = 3600
+	res := New("", config)
+	defer res.Stop(context.Background())
+	res.LaunchRefresh(time.Second)
+	if !waitFor(func() bool { return atomic.LoadInt32(&subscribes) > 0 }) {
+		t.Fatal("should try to subscribe to the event stream")
+	}
+	if !waitFor(func() bool { return atomic.LoadInt32(&polls) > 0 }) ||
+		len(res.zones[0].records().Lookup("leader.mesos.", dns.TypeA)) != 1 {
+		t.Fatal("should poll state.json without the event stream")
+	}
+
+	// later reloads keep polling
+	n := atomic.LoadInt32(&polls)
+	res.Reload()
+	if atomic.LoadInt32(&polls) != n+1 {
+		t.Error("should poll state.json on reload while not subscribed")
+	}
+}
+
+func TestStream(t *testing.T) {
+	subscribed := `{"type":"SUBSCRIBED","subscribed":{"get_state":{
+		"get_tasks":{"tasks":[{"name":"liquor-store","task_id":{"value":"liquor-store.1"},
+			"framework_id":{"value":"f1"},"agent_id":{"value":"a1"},"state":"TASK_RUNNING"}]},
+		"get_frameworks":{"frameworks":[{"framework_info":{"id":{"value":"f1"},"name":"marathon"}}]},
+		"get_agents":{"agents":[{"agent_info":{"id":{"value":"a1"},"hostname":"1.2.3.11"}}]}},
+		"heartbeat_interval_seconds":15}}`
+
+	end := make(chan struct{})
+	master := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "%d\n%s", len(subscribed), subscribed)
+		w.(http.Flusher).Flush()
+		<-end
+	}))
+	defer master.Close()
+
+	res := New("", fakeReloadConfig(master))
+	res.zones[0].launchStream(res.ctx, time.Hour)
+	if !waitFor(func() bool { return len(res.zones[0].records().Lookup("liquor-store.marathon.mesos.", dns.TypeA)) == 1 }) {
+		t.Fatal("should update the records from the event stream")
+	}
+
+	// the master doesn't serve state.json, a reload would fail anyway
+	serial := res.zones[0].snapshot().serial
+	res.Reload()
+	if res.zones[0].snapshot().serial != serial || res.zones[0].records().Hash() == "" {
+		t.Error("should not reload while subscribed")
+	}
+
+	// a poll started before the subscription doesn't replace its records
+	res.zones[0].publishPolled(&records.RecordGenerator{})
+	if res.zones[0].snapshot().serial != serial {
+		t.Error("should drop the records polled while subscribed")
+	}
+
+	close(end)
+	if !waitFor(func() bool { return atomic.LoadInt32(&res.zones[0].streaming) == 0 }) {
+		t.Error("should fall back to polling when the stream ends")
+	}
+}
+
+func TestStreamUpdate(t *testing.T) {
+	z := newZone(records.Config{Domain: "mesos"}, nil)
+
+	// the reader of the stream never waits for the records, the latest
+	// state replaces the one not published yet
+	states := make(chan records.StateJSON, 1)
+	z.streamUpdate(records.StateJSON{Leader: "master@10.0.0.1:5050"}, states)
+	z.streamUpdate(records.StateJSON{Leader: "master@10.0.0.2:5050"}, states)
+	if sj := <-states; sj.Leader != "master@10.0.0.2:5050" {
+		t.Errorf("expected the latest state instead of %v", sj)
+	}
+	if atomic.LoadInt32(&z.streaming) != 1 {
+		t.Error("should be streaming once updated")
+	}
+}
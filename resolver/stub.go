@@ -0,0 +1,298 @@
+package resolver
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/miekg/dns"
+)
+
+const (
+	// consecutive failures after which a server of a stub zone is down
+	stubMaxFailures = 3
+	// time after the last failure of a down server before it is tried
+	// again before the others
+	stubRetryInterval = 30 * time.Second
+	// the longest time an answer is cached, whatever its TTL
+	stubMaxCacheTTL = 5 * time.Minute
+	// the most answers cached for a stub zone
+	stubCacheSize = 10000
+)
+
+// stubZone forwards the queries for the domain of a peer Mesos cluster to
+// the mesos-dns servers of that cluster, and caches their answers
+type stubZone struct {
+	apex    string
+	servers []*stubServer
+	timeout time.Duration
+
+	cacheLock sync.Mutex
+	cache     map[string]cachedAnswer
+}
+
+// stubServer is a mesos-dns server of a peer cluster, along with its
+// health
+type stubServer struct {
+	addr        string
+	lock        sync.Mutex
+	failures    int // consecutive failures
+	lastFailure time.Time
+}
+
+// cachedAnswer is an answer of a stub zone server, served from the cache
+// until it expires
+type cachedAnswer struct {
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+func newStubZone(domain string, addrs []string, timeout time.Duration) *stubZone {
+	s := &stubZone{
+		apex:    domain + ".",
+		timeout: timeout,
+		cache:   make(map[string]cachedAnswer),
+	}
+	for _, addr := range addrs {
+		s.servers = append(s.servers, &stubServer{addr: addr})
+	}
+	return s
+}
+
+// stubOf returns the stub zone with the longest domain that name is in, or
+// nil if there is none
+func (res *Resolver) stubOf(name string) *stubZone {
+	var found *stubZone
+	for _, s := range res.stubs {
+		if (name == s.apex || strings.HasSuffix(name, "."+s.apex)) && (found == nil || len(s.apex) > len(found.apex)) {
+			found = s
+		}
+	}
+	return found
+}
+
+// HandleStub is a resolver request handler that forwards the questions for
+// the domain of a stub zone to the mesos-dns servers of the peer cluster,
+// the healthy ones first. answers are cached for their TTL, whatever the
+// protocol they were forwarded over, and truncated for UDP clients.
+// questions get a SERVFAIL answer if no server answers.
+func (res *Resolver) HandleStub(w dns.ResponseWriter, r *dns.Msg) {
+	var err error
+
+	// tracing info
+	res.metrics.StubRequests.Inc()
+
+	q := r.Question[0]
+	s := res.stubOf(strings.ToLower(q.Name))
+	key := strings.ToLower(q.Name) + " " + dns.TypeToString[q.Qtype] + " " + dns.ClassToString[q.Qclass]
+
+	now := time.Now()
+	m := s.cached(key, now)
+	if m != nil {
+		res.metrics.StubCacheHits.Inc()
+		setUpstream(w, "cache")
+		m.Id = r.Id
+		m.Question = r.Question
+	} else {
+		proto := "udp"
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			proto = "tcp"
+		}
+		var upstream string
+		m, upstream, err = s.forward(r, proto)
+		if err != nil {
+			logging.Error.Println("no server of stub zone " + s.apex + " answered " + q.Name + ": " + err.Error())
+			res.metrics.StubFailed.Inc()
+			m = new(dns.Msg)
+			m.SetRcode(r, dns.RcodeServerFailure)
+		} else {
+			setUpstream(w, upstream)
+			s.store(key, m, now)
+		}
+	}
+
+	truncate(w, r, m)
+	err = w.WriteMsg(m)
+	if err != nil {
+		logging.Error.Println(err)
+	}
+}
+
+// forward sends r to the servers of the stub zone in turn, until one of
+// them answers, and returns its answer along with its address. the
+// servers share the timeout: each one gets the time left split evenly
+// between the servers left to try.
+func (s *stubZone) forward(r *dns.Msg, proto string) (*dns.Msg, string, error) {
+	var err error
+	deadline := time.Now().Add(s.timeout)
+	candidates := s.candidates(time.Now())
+	for i, srv := range candidates {
+		t := time.Until(deadline) / time.Duration(len(candidates)-i)
+		c := &dns.Client{
+			Net:          proto,
+			DialTimeout:  t,
+			ReadTimeout:  t,
+			WriteTimeout: t,
+		}
+		var in *dns.Msg
+		in, _, err = c.Exchange(r, srv.addr)
+		if err == nil {
+			srv.succeeded()
+			return in, srv.addr, nil
+		}
+		srv.failed(time.Now())
+		logging.VeryVerbose.Println("Warning: server " + srv.addr + " of stub zone " + s.apex + " failed: " + err.Error())
+	}
+	return nil, "", err
+}
+
+// candidates returns the servers in the order to try them: those that
+// are up in the order of the config, then those that are down
+func (s *stubZone) candidates(now time.Time) []*stubServer {
+	up := make([]*stubServer, 0, len(s.servers))
+	var down []*stubServer
+	for _, srv := range s.servers {
+		if srv.up(now) {
+			up = append(up, srv)
+		} else {
+			down = append(down, srv)
+		}
+	}
+	return append(up, down...)
+}
+
+// cached returns a copy of the cached answer for key with the TTLs reduced
+// by its age, or nil if there is none or it expired
+func (s *stubZone) cached(key string, now time.Time) *dns.Msg {
+	s.cacheLock.Lock()
+	c, ok := s.cache[key]
+	s.cacheLock.Unlock()
+	if !ok || !now.Before(c.expires) {
+		return nil
+	}
+
+	m := c.msg.Copy()
+	age := uint32(now.Sub(c.stored) / time.Second)
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Rrtype != dns.TypeOPT {
+				hdr.Ttl -= age
+			}
+		}
+	}
+	return m
+}
+
+// store caches an answer for the lowest TTL of its records. only complete
+// positive and negative answers with records are cached.
+func (s *stubZone) store(key string, m *dns.Msg, now time.Time) {
+	if m.Truncated || (m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError) {
+		return
+	}
+	ttl, ok := cacheTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	s.cacheLock.Lock()
+	defer s.cacheLock.Unlock()
+	if len(s.cache) >= stubCacheSize {
+		s.evict(now)
+	}
+	s.cache[key] = cachedAnswer{msg: m.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// evict drops the expired answers from the full cache, or else any answer.
+// the cache must be locked.
+func (s *stubZone) evict(now time.Time) {
+	for key, c := range s.cache {
+		if !now.Before(c.expires) {
+			delete(s.cache, key)
+		}
+	}
+	for key := range s.cache {
+		if len(s.cache) < stubCacheSize {
+			break
+		}
+		delete(s.cache, key)
+	}
+}
+
+// cacheTTL returns the lowest TTL of the records of the answer, bounded by
+// the minimum TTL of a SOA record (RFC 2308) and by stubMaxCacheTTL
+func cacheTTL(m *dns.Msg) (time.Duration, bool) {
+	var ttl uint32
+	found := false
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := rr.Header().Ttl
+			if soa, ok := rr.(*dns.SOA); ok && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	d := time.Duration(ttl) * time.Second
+	if d > stubMaxCacheTTL {
+		d = stubMaxCacheTTL
+	}
+	return d, found
+}
+
+// up returns true unless the server failed stubMaxFailures times in a row,
+// and did so less than stubRetryInterval ago
+func (srv *stubServer) up(now time.Time) bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.failures < stubMaxFailures || now.Sub(srv.lastFailure) >= stubRetryInterval
+}
+
+func (srv *stubServer) succeeded() {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.failures = 0
+}
+
+func (srv *stubServer) failed(now time.Time) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.failures++
+	srv.lastFailure = now
+}
+
+// status reports the health of the server
+func (srv *stubServer) status() map[string]interface{} {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return map[string]interface{}{
+		"Address":     srv.addr,
+		"Healthy":     srv.failures < stubMaxFailures,
+		"Failures":    srv.failures,
+		"LastFailure": formatTime(srv.lastFailure),
+	}
+}
+
+// status reports the health of the servers of the stub zone and the size
+// of its cache
+func (s *stubZone) status() map[string]interface{} {
+	servers := make([]map[string]interface{}, 0, len(s.servers))
+	for _, srv := range s.servers {
+		servers = append(servers, srv.status())
+	}
+	s.cacheLock.Lock()
+	cached := len(s.cache)
+	s.cacheLock.Unlock()
+	return map[string]interface{}{
+		"Domain":  strings.TrimSuffix(s.apex, "."),
+		"Servers": servers,
+		"Cached":  cached,
+	}
+}
@@ -0,0 +1,173 @@
+package resolver
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/miekg/dns"
+)
+
+// fakePeer starts the mesos-dns server of a peer cluster, answering every
+// A question with 10.1.0.1. queries counts the questions it answered.
+func fakePeer(queries *int32) (*dns.Server, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	server := &dns.Server{
+		PacketConn: pc,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			if len(r.Question) == 0 {
+				return // sent by Shutdown
+			}
+			atomic.AddInt32(queries, 1)
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(10, 1, 0, 1),
+			})
+			w.WriteMsg(m)
+		}),
+	}
+	// the socket queues the questions until the server starts
+	go server.ActivateAndServe()
+	return server, nil
+}
+
+// deadAddr returns an address nothing listens on
+func deadAddr() (string, error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer pc.Close()
+	return pc.LocalAddr().String(), nil
+}
+
+func TestHandleStub(t *testing.T) {
+	var queries int32
+	peer, err := fakePeer(&queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := deadAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := New("", records.Config{
+		Domain:    "east.mesos",
+		Timeout:   1,
+		StubZones: map[string][]string{"west.mesos": {dead, peer.PacketConn.LocalAddr().String()}},
+	})
+	query := func(name string) *dns.Msg {
+		w := &fakeWriter{}
+		res.HandleStub(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		return w.msg
+	}
+
+	m := query("app.marathon.west.mesos.")
+	if m.Rcode != dns.RcodeSuccess || len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "10.1.0.1" {
+		t.Fatalf("expected the answer of the peer instead of %v", m)
+	}
+	if m = query("app.marathon.west.mesos."); len(m.Answer) != 1 || atomic.LoadInt32(&queries) != 1 {
+		t.Errorf("expected the cached answer instead of %d queries of the peer", queries)
+	}
+
+	// the dead server fails twice more, then is tried last
+	query("a.west.mesos.")
+	query("b.west.mesos.")
+	s := res.stubs[0]
+	if status := s.servers[0].status(); status["Healthy"] != false || status["Failures"] != stubMaxFailures {
+		t.Errorf("expected the dead server to be down instead of %v", status)
+	}
+	if candidates := s.candidates(s.servers[0].lastFailure); candidates[0] != s.servers[1] {
+		t.Error("expected to try the healthy server first")
+	}
+
+	peer.Shutdown()
+	if m = query("c.west.mesos."); m.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected SERVFAIL without a server instead of %v", m)
+	}
+}
+
+func TestStubTimeout(t *testing.T) {
+	var queries int32
+	peer, err := fakePeer(&queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Shutdown()
+
+	// a server that never answers, tried first
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	res := New("", records.Config{
+		Domain:    "east.mesos",
+		Timeout:   2,
+		StubZones: map[string][]string{"west.mesos": {silent.LocalAddr().String(), peer.PacketConn.LocalAddr().String()}},
+	})
+	start := time.Now()
+	w := &fakeWriter{}
+	res.HandleStub(w, new(dns.Msg).SetQuestion("app.marathon.west.mesos.", dns.TypeA))
+	if w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Fatalf("expected the answer of the second server instead of %v", w.msg)
+	}
+	if elapsed := time.Since(start); elapsed >= 2*time.Second {
+		t.Errorf("expected an answer within the timeout instead of %v", elapsed)
+	}
+}
+
+func TestStubTruncate(t *testing.T) {
+	res := New("", records.Config{
+		Domain:    "east.mesos",
+		StubZones: map[string][]string{"west.mesos": {"127.0.0.1:53"}},
+	})
+
+	// an answer forwarded over TCP, too large for UDP
+	r := new(dns.Msg).SetQuestion("app.marathon.west.mesos.", dns.TypeA)
+	m := new(dns.Msg).SetReply(r)
+	for i := 0; i < 100; i++ {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "app.marathon.west.mesos.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 1, 0, byte(i)),
+		})
+	}
+	s := res.stubs[0]
+	s.store("app.marathon.west.mesos. A IN", m, time.Now())
+
+	w := &fakeWriter{}
+	res.HandleStub(w, r)
+	if !w.msg.Truncated || w.msg.Len() > dns.MinMsgSize {
+		t.Errorf("expected the cached answer truncated for UDP instead of %d bytes", w.msg.Len())
+	}
+	if c := s.cached("app.marathon.west.mesos. A IN", time.Now()); c == nil || c.Truncated || len(c.Answer) != 100 {
+		t.Error("should keep the whole answer in the cache")
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	m := new(dns.Msg)
+	if _, ok := cacheTTL(m); ok {
+		t.Error("should not cache answers without records")
+	}
+
+	m.Ns = append(m.Ns, &dns.SOA{Hdr: dns.RR_Header{Name: "west.mesos.", Rrtype: dns.TypeSOA, Ttl: 60}, Minttl: 5})
+	if ttl, ok := cacheTTL(m); !ok || ttl.Seconds() != 5 {
+		t.Errorf("expected the minimum TTL of the SOA record instead of %v", ttl)
+	}
+
+	m.Ns[0].Header().Ttl, m.Ns[0].(*dns.SOA).Minttl = 86400, 86400
+	if ttl, _ := cacheTTL(m); ttl != stubMaxCacheTTL {
+		t.Errorf("expected at most %v instead of %v", stubMaxCacheTTL, ttl)
+	}
+}
@@ -0,0 +1,368 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mesos/mesos-go/detector"
+	_ "github.com/mesos/mesos-go/detector/zoo"
+	mesos "github.com/mesos/mesos-go/mesosproto"
+	"github.com/mesosphere/mesos-dns/logging"
+	"github.com/mesosphere/mesos-dns/records"
+	"github.com/mesosphere/mesos-dns/util"
+)
+
+// zone holds the records of a Mesos cluster, served under its domain, and
+// keeps them up to date with its masters
+type zone struct {
+	config     records.Config
+	metrics    *logging.LogOut
+	apex       string
+	source     records.StateSource
+	snap       atomic.Value // *snapshot
+	checked    atomic.Value // time.Time of the last successful reload
+	failure    atomic.Value // string, the error of the last reload if it failed
+	reloadLock sync.Mutex
+	streaming  int32 // 1 while subscribed to the event stream, accessed atomically
+	leader     string
+	detector   detector.Master // guarded by leaderLock
+	leaderLock sync.RWMutex
+	running    sync.WaitGroup // the refresh loops
+}
+
+// snapshot is an immutable record set along with the SOA serial it is
+// served with, queries load it without locking while reloads replace it
+// when the records change. each snapshot has an answer order of its own,
+// so that the round-robin state starts over with new records.
+type snapshot struct {
+	rs      *records.RecordGenerator
+	serial  uint32
+	changed time.Time
+	order   answerOrder
+}
+
+// newSnapshot returns a snapshot of rs, ordering the answers as configured
+func (z *zone) newSnapshot(rs *records.RecordGenerator, serial uint32, changed time.Time) *snapshot {
+	return &snapshot{
+		rs:      rs,
+		serial:  serial,
+		changed: changed,
+		order:   newAnswerOrder(z.config.AnswerOrder, rs),
+	}
+}
+
+func newZone(config records.Config, metrics *logging.LogOut) *zone {
+	z := &zone{
+		config:  config,
+		metrics: metrics,
+		apex:    config.Domain + ".",
+		source:  records.NewStateSource(config),
+	}
+	z.snap.Store(z.newSnapshot(&records.RecordGenerator{}, config.SOASerial, time.Time{}))
+	z.checked.Store(time.Time{})
+	z.failure.Store("")
+	if err := z.restore(); err != nil {
+		logging.Error.Println("records of " + z.apex + " not restored: " + err.Error())
+	}
+	return z
+}
+
+// return the current snapshot. it is shared by all the queries, attempts to
+// write to it will likely result in a data race.
+func (z *zone) snapshot() *snapshot {
+	return z.snap.Load().(*snapshot)
+}
+
+// return the current (read-only) record set, see snapshot
+func (z *zone) records() *records.RecordGenerator {
+	return z.snapshot().rs
+}
+
+// available returns true once the records of the cluster were loaded
+func (z *zone) available() bool {
+	return !z.checked.Load().(time.Time).IsZero()
+}
+
+// staleness returns how long ago the records were last loaded if the
+// reloads failed since, or else 0, also if they were never loaded
+func (z *zone) staleness(now time.Time) time.Duration {
+	if z.failure.Load().(string) == "" || !z.available() {
+		return 0
+	}
+	return now.Sub(z.checked.Load().(time.Time))
+}
+
+// serving returns true once the records are loaded, as long as they are
+// not stale for longer than MaxStaleness
+func (z *zone) serving(now time.Time) bool {
+	if !z.available() {
+		return false
+	}
+	max := time.Duration(z.config.MaxStaleness) * time.Second
+	return max == 0 || z.staleness(now) <= max
+}
+
+// publish replaces the current snapshot with one for rs, unless rs has the
+// same records. the serial is the time of the change, but always greater
+// than the current one so that secondaries notice every change. the
+// snapshot is saved when it changes, see save, or else only the time of
+// the reload is, see touch.
+func (z *zone) publish(rs *records.RecordGenerator) {
+	z.reloadLock.Lock()
+	defer z.reloadLock.Unlock()
+	z.publishLocked(rs)
+}
+
+// publishPolled publishes the records polled from the master, unless the
+// zone subscribed to the event stream while they were loaded: the updates
+// of the stream are newer.
+func (z *zone) publishPolled(rs *records.RecordGenerator) {
+	z.reloadLock.Lock()
+	defer z.reloadLock.Unlock()
+	if atomic.LoadInt32(&z.streaming) == 1 {
+		logging.VeryVerbose.Println("subscribed to the event stream of " + z.apex + " while reloading, dropping the reload")
+		return
+	}
+	z.publishLocked(rs)
+}
+
+// publishLocked publishes rs, see publish. reloadLock must be held.
+func (z *zone) publishLocked(rs *records.RecordGenerator) {
+	now := time.Now()
+	z.checked.Store(now)
+	z.failure.Store("")
+	z.metrics.Reloads.Inc()
+
+	snap := z.snapshot()
+	if rs.Hash() == snap.rs.Hash() {
+		logging.VeryVerbose.Println("records of " + z.apex + " unchanged, keeping serial " + strconv.FormatUint(uint64(snap.serial), 10))
+		if err := z.touch(snap, now); err != nil {
+			logging.Error.Println("snapshot of " + z.apex + " not updated: " + err.Error())
+		}
+		return
+	}
+	serial := uint32(now.Unix())
+	if serial <= snap.serial {
+		serial = snap.serial + 1
+	}
+	snap = z.newSnapshot(rs, serial, now)
+	z.snap.Store(snap)
+	z.metrics.RecordChanges.Inc()
+	logging.Verbose.Println("records of " + z.apex + " changed, new serial " + strconv.FormatUint(uint64(serial), 10))
+
+	if err := z.save(snap, now); err != nil {
+		logging.Error.Println("snapshot of " + z.apex + " not saved: " + err.Error())
+	}
+}
+
+// triggers a new refresh from mesos master, unless the records are kept up
+// to date by the event stream (see launchStream)
+func (z *zone) reload() {
+	if atomic.LoadInt32(&z.streaming) == 1 {
+		logging.VeryVerbose.Println("subscribed to the event stream of " + z.apex + ", skipping reload")
+		return
+	}
+
+	// Being very conservative
+	z.leaderLock.RLock()
+	currentLeader := z.leader
+	z.leaderLock.RUnlock()
+	t, err := z.source.Records(currentLeader, z.config)
+
+	if err == nil {
+		z.publishPolled(t)
+	} else {
+		z.failure.Store(err.Error())
+		logging.VeryVerbose.Println("Warning: state of " + z.apex + " not loaded (" + err.Error() + "); keeping old DNS state")
+		if z.available() && !z.serving(time.Now()) {
+			logging.Error.Println("records of " + z.apex + " stale for more than " + strconv.Itoa(z.config.MaxStaleness) + " seconds, answering SERVFAIL")
+		}
+	}
+}
+
+// status reports the state of the records: the serial, when they last
+// changed and when the master was last checked for changes, whether the
+// last check failed, and for how long in seconds the records are stale
+func (z *zone) status() map[string]interface{} {
+	now := time.Now()
+	snap := z.snapshot()
+	failure := z.failure.Load().(string)
+	return map[string]interface{}{
+		"Domain":      z.config.Domain,
+		"Serial":      snap.serial,
+		"Hash":        snap.rs.Hash(),
+		"LastChanged": formatTime(snap.changed),
+		"LastChecked": formatTime(z.checked.Load().(time.Time)),
+		"Healthy":     z.available() && failure == "",
+		"Error":       failure,
+		"Staleness":   int(z.staleness(now) / time.Second),
+		"Serving":     z.serving(now),
+	}
+}
+
+// launchRefresh keeps the records up to date until ctx is done, returns
+// immediately. they are reloaded every RefreshSeconds and whenever
+// Zookeeper detects a new leader, and updated with every event while
+// subscribed to the event stream. unrecoverable errors of the master
+// detector are sent to errCh.
+func (z *zone) launchRefresh(ctx context.Context, zkInitialDetectionTimeout time.Duration, errCh chan<- error) {
+	var newLeader <-chan struct{}
+	if z.config.Zk != "" {
+		var zkErr <-chan error
+		newLeader, zkErr = z.launchZK(ctx, zkInitialDetectionTimeout)
+		go func() {
+			select {
+			case err := <-zkErr:
+				errCh <- fmt.Errorf("cluster %s: %v", z.config.Domain, err)
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	interval := time.Second * time.Duration(z.config.RefreshSeconds)
+	if z.config.StateStream {
+		z.launchStream(ctx, interval)
+	}
+
+	z.running.Add(1)
+	go func() {
+		defer util.HandleCrash()
+		defer z.running.Done()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		for {
+			select {
+			case <-newLeader:
+			case <-timer.C:
+			case <-ctx.Done():
+				return
+			}
+			z.reload()
+			z.metrics.Print()
+
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(interval)
+		}
+	}()
+}
+
+// launches Zookeeper detector, returns immediately two chans: the first fires an empty
+// struct whenever there's a new mesos leader, the second if there's an unrecoverable
+// error in the master detector.
+// the detector is canceled once ctx is done, before z.running is done.
+func (z *zone) launchZK(ctx context.Context, initialDetectionTimeout time.Duration) (<-chan struct{}, <-chan error) {
+	errCh := make(chan error, 1)
+	leaderCh := make(chan struct{}, 1)
+	listenerFunc := func(newLeader bool) {
+		if newLeader {
+			// don't block if the buffer is full
+			select {
+			case leaderCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	z.running.Add(1)
+	go func() {
+		defer util.HandleCrash()
+		defer z.running.Done()
+
+		startedCh, err := z.zkDetect(listenerFunc)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		logging.VeryVerbose.Println("Warning: waiting for initial information from Zookeper.")
+		select {
+		case <-startedCh:
+			logging.VeryVerbose.Println("Warning: got initial information from Zookeper.")
+		case <-time.After(initialDetectionTimeout):
+			// keep serving the records restored or loaded from the
+			// masters until Zookeeper is back
+			logging.Error.Println("timed out waiting for initial ZK detection of " + z.apex + ", still waiting")
+		case <-ctx.Done():
+		}
+		<-ctx.Done()
+		z.stopZK()
+	}()
+	return leaderCh, errCh
+}
+
+// newDetector creates the master detectors, tests replace it
+var newDetector = detector.New
+
+// Start a Zookeeper listener to track leading master, returns a signal chan
+// that closes upon the first leader detection notification (and z.leader is
+// meaningfully readable).
+func (z *zone) zkDetect(leaderChanged func(bool)) (<-chan struct{}, error) {
+
+	// start listener
+	logging.Verbose.Println("Starting master detector for ZK ", z.config.Zk)
+	md, err := newDetector(z.config.Zk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create master detector: %v", err)
+	}
+	z.leaderLock.Lock()
+	z.detector = md
+	z.leaderLock.Unlock()
+
+	// and listen for master changes
+	var startedOnce sync.Once
+	started := make(chan struct{})
+	if err := md.Detect(detector.OnMasterChanged(func(info *mesos.MasterInfo) {
+		// making this atomic
+		z.leaderLock.Lock()
+		defer z.leaderLock.Unlock()
+		if leaderChanged != nil {
+			defer func() {
+				leaderChanged(z.leader != "")
+			}()
+		}
+		logging.VeryVerbose.Println("Updated Zookeeper info: ", info)
+		if info == nil {
+			z.leader = ""
+			logging.Error.Println("No leader available in Zookeeper.")
+		} else if host := info.GetHostname(); host != "" {
+			z.leader = host
+		} else {
+			// unpack IPv4
+			octets := make([]byte, 4, 4)
+			binary.BigEndian.PutUint32(octets, info.GetIp())
+			ipv4 := net.IP(octets)
+			z.leader = ipv4.String()
+		}
+		if len(z.leader) > 0 {
+			z.leader = fmt.Sprintf("%s:%d", z.leader, info.GetPort())
+		}
+		logging.Verbose.Println("New master in Zookeeper ", z.leader)
+		startedOnce.Do(func() { close(started) })
+	})); err != nil {
+		return nil, fmt.Errorf("failed to initialize master detector: %v", err)
+	}
+	return started, nil
+}
+
+// stopZK cancels the master detector, if any
+func (z *zone) stopZK() {
+	z.leaderLock.Lock()
+	md := z.detector
+	z.detector = nil
+	z.leaderLock.Unlock()
+	if md != nil {
+		logging.Verbose.Println("Stopping master detector for ZK ", z.config.Zk)
+		md.Cancel()
+	}
+}